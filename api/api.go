@@ -2,22 +2,34 @@
 package api
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/pat"
 	"github.com/nanobox-io/golang-nanoauth"
 
+	"github.com/nanobox-io/slurp/buildid"
 	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/core"
+	"github.com/nanobox-io/slurp/logs"
+	"github.com/nanobox-io/slurp/metrics"
 )
 
 var (
 	badJson      = errors.New("Bad JSON Syntax Received in Body")
 	bodyReadFail = errors.New("Body Read Failed")
+	badToken     = errors.New("Bad X-AUTH-TOKEN")
+
+	// set once Drain is called
+	draining int32
 )
 
 type (
@@ -36,22 +48,129 @@ func StartApi() error {
 		return fmt.Errorf("Failed to parse 'api-address' - %v", err)
 	}
 
-	var auth nanoauth.Auth
-	auth.Header = "X-AUTH-TOKEN"
+	// calls refused for their token are logged like any other
+	handler := accessHandler(authHandler(drainHandler(routes()), "/ping", "/metrics"))
 
 	if uri.Scheme == "http" {
 		config.Log.Info("Api listening at http://%s...", uri.Host)
-		return auth.ListenAndServe(uri.Host, config.ApiToken, routes(), "/ping")
+		return http.ListenAndServe(uri.Host, handler)
 	}
 
 	cert, err := nanoauth.Generate("slurp.nanobox.io")
 	if err != nil {
 		return err
 	}
-	auth.Certificate = cert
+	server := &http.Server{
+		Addr:      uri.Host,
+		Handler:   handler,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{*cert}},
+	}
 
 	config.Log.Info("Api listening at https://%s...", uri.Host)
-	return auth.ListenAndServeTLS(uri.Host, config.ApiToken, routes(), "/ping")
+	return server.ListenAndServeTLS("", "")
+}
+
+// authHandler refuses calls without config.ApiToken in their X-AUTH-TOKEN
+// header, but for the open paths
+func authHandler(h http.Handler, open ...string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, path := range open {
+			if req.URL.Path == path {
+				h.ServeHTTP(rw, req)
+				return
+			}
+		}
+
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("X-AUTH-TOKEN")), []byte(config.ApiToken)) != 1 {
+			writeBody(rw, req, apiError{badToken.Error()}, http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// access is the response to an api call, as it is logged
+type access struct {
+	http.ResponseWriter
+	requestId string
+	buildId   string // for calls without one in the route
+	status    int
+	err       string
+}
+
+func (self *access) WriteHeader(status int) {
+	self.status = status
+	self.ResponseWriter.WriteHeader(status)
+}
+
+// accessHandler logs every call, and hands out the request id it is logged
+// under in the X-Request-Id header
+func accessHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		a := &access{ResponseWriter: rw, requestId: logs.NewId(), status: http.StatusOK}
+		rw.Header().Set("X-Request-Id", a.requestId)
+
+		h.ServeHTTP(a, req)
+
+		// the router adds the route's build id to the query
+		buildId := a.buildId
+		if buildId == "" {
+			buildId = req.URL.Query().Get(":buildId")
+		}
+
+		outcome := "ok"
+		if a.status >= 400 {
+			outcome = "error"
+		}
+
+		logs.Access(logs.Entry{
+			Kind:      "api",
+			RequestId: a.requestId,
+			BuildId:   buildId,
+			Remote:    req.RemoteAddr,
+			Op:        req.Method + " " + req.RequestURI,
+			Duration:  time.Since(start).Seconds(),
+			Outcome:   outcome,
+			Status:    a.status,
+			Error:     a.err,
+		})
+	})
+}
+
+// noteBuild sets the build id a call is logged with, for routes without one
+func noteBuild(rw http.ResponseWriter, buildId string) {
+	if a, ok := rw.(*access); ok {
+		a.buildId = buildId
+	}
+}
+
+// caller is who made an api call, for core to audit the changes it makes and
+// log the backend requests it sends
+func caller(rw http.ResponseWriter, req *http.Request) logs.Caller {
+	// every caller authenticates with the one api token
+	c := logs.Caller{Actor: req.RemoteAddr, User: "api-token"}
+	if a, ok := rw.(*access); ok {
+		c.RequestId = a.requestId
+	}
+	return c
+}
+
+// Drain makes the api refuse every call but reads, so no new stages or commits
+// start while slurp shuts down. Stages and commits can still be followed.
+func Drain() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+// drainHandler refuses calls once the api is draining
+func drainHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && atomic.LoadInt32(&draining) == 1 {
+			writeBody(rw, req, apiError{slurp.ErrShuttingDown.Error()}, http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
 }
 
 // api routes
@@ -60,32 +179,48 @@ func routes() *pat.Router {
 
 	// keep "/stages" so a build named "ping" won't break anything
 	router.Post("/stages", addStage)
-	router.Put("/stages/{buildId}", commitStage)
-	router.Delete("/stages/{buildId}", deleteStage)
+	router.Put("/stages/{buildId}/archive", validId(uploadStage))
+	router.Put("/stages/{buildId}", validId(commitStage))
+	router.Delete("/stages/{buildId}", validId(deleteStage))
+	// pat matches prefixes, the more specific route goes first
+	router.Get("/stages/{buildId}", validId(getStage))
+	router.Get("/stages", listStages)
+	router.Get("/commits/{commitId}", getCommit)
+	router.Get("/builds/{buildId}/manifest", validId(getManifest))
+	router.Get("/builds/{buildId}/diff", validId(diffBuilds))
+	router.Get("/builds/{buildId}", validId(getBuild))
 
 	router.Get("/ping", pong)
+	router.Add("GET", "/metrics", metrics.Handler())
 
 	return router
 }
 
-// write the json body and log the request
+// validId refuses a request for a build id that doesn't fit the grammar
+func validId(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		err := buildid.Validate(req.URL.Query().Get(":buildId"))
+		if err != nil {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+			return
+		}
+		h(rw, req)
+	}
+}
+
+// write the json body, noting any error for the access log
 func writeBody(rw http.ResponseWriter, req *http.Request, v interface{}, status int) error {
 	b, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	// print the error only if there is one
-	var msg map[string]string
-	json.Unmarshal(b, &msg)
-
-	var errMsg string
-	if msg["error"] != "" {
-		errMsg = msg["error"]
+	if e, ok := v.(apiError); ok {
+		if a, ok := rw.(*access); ok {
+			a.err = e.ErrorString
+		}
 	}
 
-	config.Log.Debug("%s %d %s %s %s", req.RemoteAddr, status, req.Method, req.RequestURI, errMsg)
-
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(status)
 	rw.Write(append(b, byte('\n')))
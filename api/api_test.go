@@ -1,12 +1,17 @@
 package api_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,11 +20,14 @@ import (
 	"github.com/nanobox-io/slurp/api"
 	"github.com/nanobox-io/slurp/backend"
 	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/logs"
 )
 
 func TestMain(m *testing.M) {
-	// clean test dir
+	// clean test dirs
 	os.RemoveAll("/tmp/slurpApi")
+	os.RemoveAll("/tmp/slurpApiCache")
+	os.Remove("/tmp/slurpApiAudit.log")
 
 	// manually configure
 	initialize()
@@ -29,8 +37,10 @@ func TestMain(m *testing.M) {
 	<-time.After(2 * time.Second)
 	rtn := m.Run()
 
-	// clean test dir
+	// clean test dirs
 	os.RemoveAll("/tmp/slurpApi")
+	os.RemoveAll("/tmp/slurpApiCache")
+	os.Remove("/tmp/slurpApiAudit.log")
 
 	os.Exit(rtn)
 }
@@ -50,7 +60,16 @@ func TestAddStage(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if string(body) != "{\"secret\":\"newbuild\"}\n" {
+	if !strings.HasPrefix(string(body), "{\"user\":\"newbuild\",\"secret\":\"") || strings.Contains(string(body), "key") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// already staged
+	body, err = rest("POST", "/stages", "{\"new-id\": \"newbuild\"}")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"Build Already Staged\"}\n" {
 		t.Errorf("%q doesn't match expected out", body)
 	}
 
@@ -63,6 +82,15 @@ func TestAddStage(t *testing.T) {
 		t.Errorf("%q doesn't match expected out", body)
 	}
 
+	// bad ttl
+	body, err = rest("POST", "/stages", "{\"new-id\": \"newbuild\", \"ttl\": \"forever\"}")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(string(body), "{\"error\":\"Bad TTL") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
 	// missing payload
 	body, err = rest("POST", "/stages", "{}")
 	if err != nil {
@@ -71,10 +99,64 @@ func TestAddStage(t *testing.T) {
 	if string(body) != "{\"error\":\"Missing Payload Data\"}\n" {
 		t.Errorf("%q doesn't match expected out", body)
 	}
+
+	// build dir too full
+	config.MinFree = 1 << 62
+	body, err = rest("POST", "/stages", "{\"new-id\": \"fullbuild\"}")
+	config.MinFree = 0
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"Not Enough Free Space For A New Stage\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+func TestGetStage(t *testing.T) {
+	body, err := rest("GET", "/stages/newbuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(body), "\"new-id\":\"newbuild\"") || !strings.Contains(string(body), "\"state\":\"staged\"") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("GET", "/stages", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(string(body), "[{\"new-id\":\"newbuild\"") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// not found
+	body, err = rest("GET", "/stages/nobuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"No Build Found\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
 }
 
 func TestCommitStage(t *testing.T) {
-	body, err := rest("PUT", "/stages/newbuild", "")
+	body, err := rest("PUT", "/stages/newbuild?codec=lzma", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"Bad codec - Unknown codec 'lzma'\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("PUT", "/stages/newbuild?priority=high", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(string(body), "{\"error\":\"Bad priority") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("PUT", "/stages/newbuild?codec=gzip:1&priority=10", "")
 	if err != nil {
 		t.Error(err)
 	}
@@ -91,6 +173,259 @@ func TestDeleteStage(t *testing.T) {
 	if string(body) != "{\"msg\":\"Success\"}\n" {
 		t.Errorf("%q doesn't match expected out", body)
 	}
+
+	body, err = rest("DELETE", "/stages/.stages.json", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(string(body), "{\"error\":\"Invalid build id") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+func TestInvalidId(t *testing.T) {
+	body, err := rest("POST", "/stages", "{\"new-id\": \"../../etc\"}")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"Invalid build id \\\"../../etc\\\" - it must start with a letter or digit\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	_, err := rest("POST", "/stages", "{\"new-id\": \"auditbuild\"}")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = rest("DELETE", "/stages/auditbuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	b, err := ioutil.ReadFile(config.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{logs.ActionCreate, logs.ActionDelete} {
+		if !strings.Contains(string(b), fmt.Sprintf("\"action\":%q,\"build-id\":\"auditbuild\"", action)) {
+			t.Errorf("No %v record in %q", action, b)
+		}
+	}
+	if !strings.Contains(string(b), "\"user\":\"api-token\"") {
+		t.Errorf("No api user in %q", b)
+	}
+}
+
+func TestBadToken(t *testing.T) {
+	req, _ := http.NewRequest("GET", config.ApiAddress+"/stages", nil)
+	req.Header.Add("X-AUTH-TOKEN", "wrong")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("%d doesn't match expected status", res.StatusCode)
+	}
+	// refused calls are logged, under a request id like any other
+	if res.Header.Get("X-Request-Id") == "" {
+		t.Errorf("Refused call wasn't given a request id")
+	}
+}
+
+func TestCommitStageAsync(t *testing.T) {
+	_, err := rest("POST", "/stages", "{\"new-id\": \"asyncbuild\"}")
+	if err != nil {
+		t.Error(err)
+	}
+
+	body, err := rest("PUT", "/stages/asyncbuild?async=true", "")
+	if err != nil {
+		t.Error(err)
+	}
+	var commit struct {
+		Id      string `json:"id"`
+		BuildId string `json:"build-id"`
+	}
+	err = json.Unmarshal(body, &commit)
+	if err != nil || commit.BuildId != "asyncbuild" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// poll by the commit's id until it finishes
+	for i := 0; i < 50; i++ {
+		body, err = rest("GET", "/commits/"+commit.Id, "")
+		if err != nil {
+			t.Error(err)
+		}
+		if !strings.Contains(string(body), "\"state\":\"running\"") {
+			break
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+	if !strings.Contains(string(body), "\"state\":\"done\"") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// the stage is removed once committed
+	body, err = rest("GET", "/stages/asyncbuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"No Build Found\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// and both are audited, though the call had already returned
+	b, err := ioutil.ReadFile(config.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{logs.ActionCommitStarted, logs.ActionCommit, logs.ActionDelete} {
+		if !strings.Contains(string(b), fmt.Sprintf("\"action\":%q,\"build-id\":\"asyncbuild\"", action)) {
+			t.Errorf("No %v record in %q", action, b)
+		}
+	}
+}
+
+func TestUploadStage(t *testing.T) {
+	body, err := rest("PUT", "/stages/tarbuild/archive", tarball(false))
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(body), "\"new-id\":\"tarbuild\"") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+	content, err := ioutil.ReadFile("/tmp/slurpApi/tarbuild/app/index.html")
+	if err != nil || string(content) != "hello" {
+		t.Errorf("%q doesn't match expected content - %v", content, err)
+	}
+
+	// not an archive
+	body, err = rest("PUT", "/stages/tarbuild/archive", "garbage")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(body), "Bad archive") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// nor is a stage created for one left behind
+	rest("PUT", "/stages/badbuild/archive", "garbage")
+	body, err = rest("GET", "/stages/badbuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"No Build Found\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// gzipped and committed right away
+	body, err = rest("PUT", "/stages/tgzbuild/archive?commit=true", tarball(true))
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"msg\":\"Success\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+	body, err = rest("GET", "/stages/tgzbuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"No Build Found\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+func TestGetBuild(t *testing.T) {
+	// committed by TestUploadStage
+	body, err := rest("GET", "/builds/tgzbuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("build isn't gzipped - %v", err)
+	} else {
+		zr.Close()
+	}
+
+	body, err = rest("GET", "/builds/tgzbuild?file=app/index.html", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("GET", "/builds/tgzbuild?file=app/missing.html", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"No File Found\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("GET", "/builds/tgzbuild/manifest", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(body), `"path":"app/index.html","size":5`) {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("GET", "/builds/tgzbuild/diff?from=tgzbuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(body), `"added":[],"removed":[],"changed":[]`) {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("GET", "/builds/nosuchbuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"No Build Found\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	body, err := rest("GET", "/metrics", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(body), `slurp_operations_total{op="add",result="ok"}`) {
+		t.Errorf("%q doesn't contain stage operations", body)
+	}
+	if !strings.Contains(string(body), "slurp_backend_request_duration_seconds") {
+		t.Errorf("%q doesn't contain backend requests", body)
+	}
+}
+
+// must run last, a drained api stays drained
+func TestDrain(t *testing.T) {
+	api.Drain()
+
+	body, err := rest("POST", "/stages", `{"new-id": "drained"}`)
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(body), "Shutting Down") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("GET", "/ping", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "pong\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -102,18 +437,48 @@ func initialize() {
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	config.ApiToken = ""
 	config.BuildDir = "/tmp/slurpApi/"
+	config.CacheDir = "/tmp/slurpApiCache/"
 	config.LogLevel = "fatal"
 	config.SshHostKey = "/tmp/slurp_rsa"
+	config.AuditLog = "/tmp/slurpApiAudit.log"
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
 
+	err := logs.Open()
+	if err != nil {
+		fmt.Printf("Logs init failed - %v\n", err)
+		os.Exit(1)
+	}
+
 	// initialize backend
-	err := backend.Initialize()
+	err = backend.Initialize()
 	if err != nil {
 		fmt.Printf("Backend init failed, skipping tests - %v\n", err)
 		os.Exit(0)
 	}
 }
 
+// tarball makes an archive holding app/index.html
+func tarball(gzipped bool) string {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+
+	var zw *gzip.Writer
+	if gzipped {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{Name: "./app/index.html", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+	tw.Write([]byte("hello"))
+	tw.Close()
+	if zw != nil {
+		zw.Close()
+	}
+
+	return buf.String()
+}
+
 // hit api and return response body
 func rest(method, route, data string) ([]byte, error) {
 	body := bytes.NewBuffer([]byte(data))
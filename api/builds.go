@@ -0,0 +1,122 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/nanobox-io/slurp/buildid"
+	"github.com/nanobox-io/slurp/core"
+)
+
+// getBuild streams a stored build, or with '?file=' a single file out of it,
+// so clients don't need credentials to the backend.
+func getBuild(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}
+	buildId := req.URL.Query().Get(":buildId")
+
+	if name := req.URL.Query().Get("file"); name != "" {
+		file, size, err := slurp.ReadBuildFile(buildId, name, caller(rw, req).RequestId)
+		if err == slurp.ErrNotFound || err == slurp.ErrFileNotFound {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		rw.Header().Set("Content-Type", contentType)
+		rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		stream(rw, req, file)
+		return
+	}
+
+	build, codec, err := slurp.ReadBuild(buildId, caller(rw, req).RequestId)
+	if err == slurp.ErrNotFound {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	defer build.Close()
+
+	contentType, ext := "application/gzip", ".tar.gz"
+	switch codec {
+	case slurp.CodecZstd:
+		contentType, ext = "application/zstd", ".tar.zst"
+	case slurp.CodecNone:
+		contentType, ext = "application/x-tar", ".tar"
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Disposition", "attachment; filename=\""+path.Base(buildId)+ext+"\"")
+	stream(rw, req, build)
+}
+
+// stream copies a body to the client, noting any error for the access log
+func stream(rw http.ResponseWriter, req *http.Request, body io.Reader) {
+	rw.WriteHeader(http.StatusOK)
+	n, err := io.Copy(rw, body)
+
+	if a, ok := rw.(*access); ok && err != nil {
+		// the status is sent already, the client only sees a short body
+		a.err = fmt.Sprintf("Failed to stream after %d bytes - %v", n, err)
+	}
+}
+
+// getManifest shows the files of a stored build
+func getManifest(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}/manifest
+	buildId := req.URL.Query().Get(":buildId")
+
+	manifest, err := slurp.GetManifest(buildId, caller(rw, req).RequestId)
+	if err == slurp.ErrNotFound {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, manifest, http.StatusOK)
+}
+
+// diffBuilds shows what changed from the build '?from=' to a stored build
+func diffBuilds(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}/diff?from={oldId}
+	buildId := req.URL.Query().Get(":buildId")
+	from := req.URL.Query().Get("from")
+	if from == "" {
+		writeBody(rw, req, apiError{"Missing 'from' build"}, http.StatusBadRequest)
+		return
+	}
+	err := buildid.Validate(from)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	diff, err := slurp.DiffBuilds(from, buildId, caller(rw, req).RequestId)
+	if err == slurp.ErrNotFound {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, diff, http.StatusOK)
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/nanobox-io/slurp/core"
+)
+
+// getCommit shows the progress, or outcome, of a commit started with
+// '?async=true'
+func getCommit(rw http.ResponseWriter, req *http.Request) {
+	// GET /commits/{commitId}
+	commitId := req.URL.Query().Get(":commitId")
+
+	commit, err := slurp.GetCommit(commitId)
+	if err == slurp.ErrNotFound {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, commit, http.StatusOK)
+}
@@ -1,8 +1,13 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/nanobox-io/slurp/buildid"
+	"github.com/nanobox-io/slurp/config"
 	"github.com/nanobox-io/slurp/core"
 )
 
@@ -10,14 +15,19 @@ import (
 type build struct {
 	OldId string `json:"old-id"` // build to fetch from storage
 	NewId string `json:"new-id"` // build to stage and store
+	TTL   string `json:"ttl"`    // idle time before the stage is removed
+	Key   bool   `json:"key"`    // also generate a keypair to ssh with
 }
 
 type auth struct {
-	AuthSecret string `json:"secret"`
+	User       string `json:"user"`          // username to ssh with
+	AuthSecret string `json:"secret"`        // password to ssh with
+	Key        string `json:"key,omitempty"` // private key to ssh with
 }
 
 // addStage prepares a directory for receiving the new build. If an old build is specified,
-// that build is fetched from hoarder, otherwise a new directory is created.
+// that build is fetched from hoarder, otherwise a new directory is created. The reply
+// holds the credential to rsync into the stage with.
 func addStage(rw http.ResponseWriter, req *http.Request) {
 	var stage build
 	err := parseBody(req, &stage)
@@ -30,33 +40,192 @@ func addStage(rw http.ResponseWriter, req *http.Request) {
 		writeBody(rw, req, apiError{"Missing Payload Data"}, http.StatusInternalServerError)
 		return
 	}
+	noteBuild(rw, stage.NewId)
+
+	err = buildid.Validate(stage.NewId)
+	if err == nil && stage.OldId != "" {
+		err = buildid.Validate(stage.OldId)
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	var ttl time.Duration
+	if stage.TTL != "" {
+		ttl, err = time.ParseDuration(stage.TTL)
+		if err != nil {
+			writeBody(rw, req, apiError{"Bad TTL - " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
 
 	// stage the build
-	err = slurp.AddStage(stage.OldId, stage.NewId)
+	login, err := slurp.AddStage(stage.OldId, stage.NewId, ttl, stage.Key, caller(rw, req))
+	if conflict(err) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+		return
+	}
+	if err == slurp.ErrShuttingDown {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
+	if err == slurp.ErrNoSpace {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
 		return
 	}
 
-	writeBody(rw, req, auth{stage.NewId}, http.StatusOK)
+	writeBody(rw, req, auth{login.User, login.Secret, login.PrivateKey}, http.StatusOK)
 }
 
 // commitStage is called once the local build is synced with the staged build. It will
 // compress and upload the staged build to hoarder. CommitStage will also remove the
-// user for security.
+// user for security. With '?async=true' it replies right away with a commit to
+// poll at /commits/{commitId}. '?codec=' overrides the configured codec, and
+// '?priority=' moves the commit ahead of queued ones with a lower priority.
 func commitStage(rw http.ResponseWriter, req *http.Request) {
 	// PUT /stages/{buildId}
 	buildId := req.URL.Query().Get(":buildId")
 
-	// commit the staged build
-	err := slurp.CommitStage(buildId)
+	codec, priority, err := commitParams(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	if async, _ := strconv.ParseBool(req.URL.Query().Get("async")); async {
+		commit, err := slurp.CommitStageAsync(buildId, codec, priority, caller(rw, req))
+		if conflict(err) {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+			return
+		}
+		if err == slurp.ErrShuttingDown || err == slurp.ErrQueueFull {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Location", "/commits/"+commit.Id)
+		writeBody(rw, req, commit, http.StatusAccepted)
+		return
+	}
+
+	commitAndDelete(rw, req, buildId, codec, priority)
+}
+
+// uploadStage extracts a tar, tar.gz or tar.zst body into a stage, adding the
+// stage first (with an optional '?ttl=') if it doesn't exist. With
+// '?commit=true' the build is committed right after (with an optional
+// '?codec=' and '?priority='), so a build can be published in one request.
+func uploadStage(rw http.ResponseWriter, req *http.Request) {
+	// PUT /stages/{buildId}/archive
+	buildId := req.URL.Query().Get(":buildId")
+
+	codec, priority, err := commitParams(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	created := false
+	_, err = slurp.GetStage(buildId)
+	if err == slurp.ErrNotFound {
+		var ttl time.Duration
+		if req.URL.Query().Get("ttl") != "" {
+			ttl, err = time.ParseDuration(req.URL.Query().Get("ttl"))
+			if err != nil {
+				writeBody(rw, req, apiError{"Bad TTL - " + err.Error()}, http.StatusBadRequest)
+				return
+			}
+		}
+
+		_, err = slurp.AddStage("", buildId, ttl, false, caller(rw, req))
+		created = err == nil
+		if err == slurp.ErrExists {
+			// staged by another call since, extract into it all the same
+			err = nil
+		}
+	}
+	if conflict(err) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+		return
+	}
+	if err == slurp.ErrShuttingDown {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
+	if err == slurp.ErrNoSpace {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
 		return
 	}
 
-	// delete the staged build
-	err = slurp.DeleteStage(buildId)
+	err = slurp.ExtractStage(buildId, req.Body, caller(rw, req))
+	if err != nil && created {
+		// a stage only this upload wanted isn't left behind
+		derr := slurp.DeleteStage(buildId, caller(rw, req))
+		if derr != nil {
+			config.Log.Error("Failed to remove stage '%v' - %v", buildId, derr)
+		}
+	}
+	if conflict(err) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+		return
+	}
+	if err == slurp.ErrQuota {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == slurp.ErrShuttingDown {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
+	if _, ok := err.(slurp.ArchiveError); ok {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	if commit, _ := strconv.ParseBool(req.URL.Query().Get("commit")); commit {
+		commitAndDelete(rw, req, buildId, codec, priority)
+		return
+	}
+
+	stage, err := slurp.GetStage(buildId)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, stage, http.StatusOK)
+}
+
+// commitAndDelete commits a staged build and removes the stage once stored,
+// without letting go of the build in between.
+func commitAndDelete(rw http.ResponseWriter, req *http.Request, buildId, codec string, priority int) {
+	// commit the staged build once it's through the queue, then delete it
+	_, err := slurp.CommitAndDeleteStage(buildId, codec, priority, caller(rw, req))
+	if conflict(err) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+		return
+	}
+	if err == slurp.ErrShuttingDown || err == slurp.ErrQueueFull {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
 		return
@@ -71,7 +240,11 @@ func deleteStage(rw http.ResponseWriter, req *http.Request) {
 	buildId := req.URL.Query().Get(":buildId")
 
 	// delete the staged build
-	err := slurp.DeleteStage(buildId)
+	err := slurp.DeleteStage(buildId, caller(rw, req))
+	if conflict(err) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+		return
+	}
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
 		return
@@ -79,3 +252,53 @@ func deleteStage(rw http.ResponseWriter, req *http.Request) {
 
 	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
 }
+
+// commitParams reads a commit's '?codec=' and '?priority=', both optional
+func commitParams(req *http.Request) (codec string, priority int, err error) {
+	codec = req.URL.Query().Get("codec")
+	if codec != "" {
+		err = slurp.ParseCodec(codec)
+		if err != nil {
+			return "", 0, fmt.Errorf("Bad codec - %v", err)
+		}
+	}
+
+	if req.URL.Query().Get("priority") != "" {
+		priority, err = strconv.Atoi(req.URL.Query().Get("priority"))
+		if err != nil {
+			return "", 0, fmt.Errorf("Bad priority - %v", err)
+		}
+	}
+
+	return codec, priority, nil
+}
+
+// conflict reports whether err is the build being busy with something else,
+// or already staged, which is answered with a 409
+func conflict(err error) bool {
+	return err == slurp.ErrCommitRunning || err == slurp.ErrBusy || err == slurp.ErrSyncing || err == slurp.ErrExists
+}
+
+// listStages shows every build slurp is holding
+func listStages(rw http.ResponseWriter, req *http.Request) {
+	// GET /stages
+	writeBody(rw, req, slurp.ListStages(), http.StatusOK)
+}
+
+// getStage shows the details of a single staged build
+func getStage(rw http.ResponseWriter, req *http.Request) {
+	// GET /stages/{buildId}
+	buildId := req.URL.Query().Get(":buildId")
+
+	stage, err := slurp.GetStage(buildId)
+	if err == slurp.ErrNotFound {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, stage, http.StatusOK)
+}
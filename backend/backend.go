@@ -2,22 +2,119 @@
 package backend
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/url"
+	"strings"
+	"time"
 
+	"github.com/minio/minio-go/v7"
+
+	"github.com/nanobox-io/slurp/buildid"
 	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/logs"
+	"github.com/nanobox-io/slurp/metrics"
 )
 
 type blobReadWriter interface {
 	initialize() error
 	readBlob(id string) (io.ReadCloser, error)
 	writeBlob(id string, blob io.Reader) error
+	hasBlob(id string) (bool, error)
+}
+
+// refMagic starts every ref blob. It can't be mistaken for the start of a
+// gzipped build.
+const refMagic = "slurp-ref\n"
+
+// Ref points a blob id at content stored under another id, so identical
+// builds are only stored once. A delta's content only holds what changed
+// since its parent.
+type Ref struct {
+	Blob    string   `json:"blob"`              // id the content is stored under
+	Codec   string   `json:"codec,omitempty"`   // what the content is compressed with, gzip if unset
+	Parent  *Ref     `json:"parent,omitempty"`  // build the delta applies to
+	Deleted []string `json:"deleted,omitempty"` // paths the delta removes from its parent
+}
+
+// bufferedBlob is a blob that has been peeked into
+type bufferedBlob struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// statusError is an error status returned by a backend
+type statusError struct {
+	msg string
+}
+
+func (self statusError) Error() string {
+	return self.msg
+}
+
+// meteredReader counts the bytes streamed to or from the backend
+type meteredReader struct {
+	io.Reader
+	bytes interface{ Add(float64) }
+}
+
+func (self meteredReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	self.bytes.Add(float64(n))
+	return n, err
+}
+
+// meteredBlob is a blob read through a meteredReader. The backend cutting it
+// short fails the read it was opened by.
+type meteredBlob struct {
+	meteredReader
+	io.Closer
+	requestId string
+	id        string
+	start     time.Time
+}
+
+func (self meteredBlob) Read(p []byte) (int, error) {
+	n, err := self.meteredReader.Read(p)
+	if err != nil && err != io.EOF {
+		observe(self.requestId, "read", self.id, self.start, err)
+	}
+	return n, err
+}
+
+// sourceReader reads what is written to the backend, keeping any error
+// reading it
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (self *sourceReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		self.err = err
+	}
+	return n, err
+}
+
+// uncounted is an error observe logs without counting it as a backend error:
+// a failure to read what was being written, or one already counted for the
+// request it failed
+type uncounted struct {
+	error
 }
 
 var (
-	backend   blobReadWriter // the pluggable (future) backend
+	backend   blobReadWriter // the pluggable backend
 	storeAddr string         // storage address
+
+	// returned when reading a blob that isn't stored
+	ErrNotFound = statusError{"Blob Not Found"}
 )
 
 // Initialize prepares the backend and ensures it is available
@@ -30,22 +127,168 @@ func Initialize() error {
 	}
 	switch u.Scheme {
 	case "hoarder": // insecure hoarder
-		backend = &hoarder{proto: "http"}
+		backend = newHoarder("http")
 	case "hoarders": // secure hoarder
-		backend = &hoarder{proto: "https"}
+		backend = newHoarder("https")
+	case "file": // local directory
+		backend = &file{dir: u.Path}
+	case "s3": // secure s3 compatible
+		backend, err = newS3(u, true)
+	case "s3+http": // insecure s3 compatible
+		backend, err = newS3(u, false)
 	default:
-		backend = &hoarder{proto: "https"}
+		backend = newHoarder("https")
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to create backend - %v", err)
 	}
 	storeAddr = u.Host
 	return backend.initialize()
 }
 
-// ReadBlob reads a blob from a storage backend
-func ReadBlob(id string) (io.ReadCloser, error) {
-	return backend.readBlob(id)
+// ReadBlob reads a blob from a storage backend, following it if it is a ref.
+// Backend requests are logged under requestId, as are those of the functions
+// below.
+func ReadBlob(requestId, id string) (io.ReadCloser, error) {
+	blob, ref, err := openBlob(requestId, id)
+	if err != nil || ref == nil {
+		return blob, err
+	}
+	return read(requestId, ref.Blob)
+}
+
+// ReadRef reads the ref stored under id, nil if id holds plain blob data
+func ReadRef(requestId, id string) (*Ref, error) {
+	blob, ref, err := openBlob(requestId, id)
+	if err != nil {
+		return nil, err
+	}
+	if blob != nil {
+		blob.Close()
+	}
+	return ref, nil
+}
+
+// HasBlob checks whether a blob exists in a storage backend
+func HasBlob(requestId, id string) (bool, error) {
+	start := time.Now()
+	has, err := backend.hasBlob(id)
+	observe(requestId, "has", id, start, err)
+	return has, err
 }
 
 // WriteBlob writes a blob to a storage backend
-func WriteBlob(id string, blob io.Reader) error {
-	return backend.writeBlob(id, blob)
+func WriteBlob(requestId, id string, blob io.Reader) error {
+	return write(requestId, id, blob)
+}
+
+// WriteRef writes a ref pointing id at other blob content
+func WriteRef(requestId, id string, ref Ref) error {
+	b, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	return write(requestId, id, bytes.NewReader(append([]byte(refMagic), b...)))
+}
+
+// openBlob opens a blob, returning either the blob or, if it is a ref, the
+// parsed ref
+func openBlob(requestId, id string) (io.ReadCloser, *Ref, error) {
+	blob, err := read(requestId, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := bufio.NewReader(blob)
+	magic, _ := buf.Peek(len(refMagic))
+	if string(magic) != refMagic {
+		return bufferedBlob{buf, blob}, nil, nil
+	}
+	defer blob.Close()
+
+	buf.Discard(len(refMagic))
+	ref := &Ref{}
+	err = json.NewDecoder(buf).Decode(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse ref '%v' - %v", id, err)
+	}
+
+	return nil, ref, nil
+}
+
+// read opens a blob, metering the request and the bytes read
+func read(requestId, id string) (io.ReadCloser, error) {
+	start := time.Now()
+	blob, err := backend.readBlob(id)
+	observe(requestId, "read", id, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return meteredBlob{meteredReader{blob, metrics.BackendRead}, blob, requestId, id, start}, nil
+}
+
+// write stores a blob, metering the request and the bytes written
+func write(requestId, id string, blob io.Reader) error {
+	start := time.Now()
+	src := &sourceReader{Reader: blob}
+	err := backend.writeBlob(id, meteredReader{src, metrics.BackendWritten})
+	if src.err != nil {
+		observe(requestId, "write", id, start, uncounted{src.err})
+		return src.err
+	}
+	observe(requestId, "write", id, start, err)
+	return err
+}
+
+// observe records the duration and any error of a backend request, and logs
+// it under the request id of the call it was made for. Only errors the backend
+// returned are counted.
+func observe(requestId, op, id string, start time.Time, err error) {
+	metrics.BackendDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if _, ok := err.(uncounted); err != nil && !ok {
+		metrics.BackendErrors.WithLabelValues(op, errorType(err)).Inc()
+	}
+
+	entry := logs.Entry{
+		Kind:      "backend",
+		RequestId: requestId,
+		BuildId:   blobBuild(id),
+		Remote:    storeAddr,
+		Op:        op + " " + id,
+		Duration:  time.Since(start).Seconds(),
+		Outcome:   logs.Outcome(err),
+	}
+	if err == ErrNotFound {
+		entry.Outcome = "missing"
+	} else if err != nil {
+		entry.Error = err.Error()
+	}
+	logs.Access(entry)
+}
+
+// blobBuild is the build a blob belongs to, if its id tells: a build's ref
+// and manifest are stored under its id, content under its digest.
+func blobBuild(id string) string {
+	id = strings.TrimSuffix(id, ".manifest")
+	if buildid.Validate(id) != nil {
+		return ""
+	}
+	return id
+}
+
+// errorType classifies a backend error as "timeout", "connection" (the backend
+// couldn't be reached), "status" (the backend refused the request) or "other"
+func errorType(err error) string {
+	var netErr net.Error
+	var status statusError
+	var s3Err minio.ErrorResponse
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "connection"
+	case errors.As(err, &status), errors.As(err, &s3Err):
+		return "status"
+	}
+	return "other"
 }
@@ -0,0 +1,110 @@
+package backend
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nanobox-io/slurp/config"
+)
+
+type file struct {
+	dir string // directory blobs are stored in
+}
+
+// ensure the blob directory exists
+func (self file) initialize() error {
+	return os.MkdirAll(self.dir, 0755)
+}
+
+// open blob from disk and return Reader for piping to next command
+func (self file) readBlob(id string) (io.ReadCloser, error) {
+	config.Log.Trace("[client] - GET file/%v", id)
+	blob, err := os.Open(filepath.Join(self.dir, id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return blob, err
+}
+
+// write blob to disk, replacing any previous blob only once it is complete
+func (self file) writeBlob(id string, blob io.Reader) error {
+	config.Log.Trace("[client] - POST file/%v", id)
+	tmp, err := ioutil.TempFile(self.dir, "."+id+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, blob)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(self.dir, id))
+}
+
+// start an upload in parts
+func (self file) startParts(id string) (string, error) {
+	return newUpload()
+}
+
+// write a part to disk as a blob of its own
+func (self file) writePart(id, upload string, n int, part io.Reader, size int64) (string, error) {
+	name := partName(id, upload, n)
+	return name, self.writeBlob(name, part)
+}
+
+// concatenate the parts into the blob, replacing any previous blob only once
+// it is complete
+func (self file) assembleParts(id, upload string, parts []string) error {
+	config.Log.Trace("[client] - POST file/%v (%d parts)", id, len(parts))
+	tmp, err := ioutil.TempFile(self.dir, "."+id+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, name := range parts {
+		var part *os.File
+		part, err = os.Open(filepath.Join(self.dir, name))
+		if err != nil {
+			break
+		}
+		_, err = io.Copy(tmp, part)
+		part.Close()
+		if err != nil {
+			break
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(self.dir, id))
+	self.abortParts(id, upload, len(parts))
+	return err
+}
+
+// remove the parts of an upload
+func (self file) abortParts(id, upload string, parts int) {
+	for n := 1; n <= parts; n++ {
+		os.Remove(filepath.Join(self.dir, partName(id, upload, n)))
+	}
+}
+
+// check for blob on disk
+func (self file) hasBlob(id string) (bool, error) {
+	_, err := os.Stat(filepath.Join(self.dir, id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
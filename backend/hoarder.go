@@ -10,7 +10,20 @@ import (
 )
 
 type hoarder struct {
-	proto string
+	proto  string
+	client *http.Client
+}
+
+// newHoarder creates a hoarder backend with a client of its own, so
+// config.Insecure doesn't reach other http clients
+func newHoarder(proto string) *hoarder {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// if insecure is false, verify cert
+	if config.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &hoarder{proto: proto, client: &http.Client{Transport: transport}}
 }
 
 // ensure hoarder is up
@@ -21,43 +34,74 @@ func (self hoarder) initialize() error {
 
 // get blob from hoarder and return Reader for piping to next command
 func (self hoarder) readBlob(id string) (io.ReadCloser, error) {
+	return self.get(id)
+}
+
+// get blob from hoarder as stored
+func (self hoarder) get(id string) (io.ReadCloser, error) {
 	res, err := self.rest("GET", "blobs/"+id, nil)
 	if err != nil { // prevent panic if no res
 		return nil, err
 	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, statusError{fmt.Sprintf("Unexpected status reading blob - %v", res.Status)}
+	}
 	return res.Body, err
 }
 
 // pipe blob to hoarder
 func (self hoarder) writeBlob(id string, blob io.Reader) error {
-	_, err := self.rest("POST", "blobs/"+id, blob)
-	return err
+	res, err := self.rest("POST", "blobs/"+id, blob)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return statusError{fmt.Sprintf("Unexpected status writing blob - %v", res.Status)}
+	}
+	return nil
+}
+
+// check for blob in hoarder
+func (self hoarder) hasBlob(id string) (bool, error) {
+	res, err := self.rest("HEAD", "blobs/"+id, nil)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, statusError{fmt.Sprintf("Unexpected status checking blob - %v", res.Status)}
 }
 
 // rest is a helper method http client to interact with hoarder
 func (self hoarder) rest(method, path string, body io.Reader) (*http.Response, error) {
 	config.Log.Trace("[client] - %v hoarder/%v", method, path)
-	var client *http.Client
-	client = http.DefaultClient
 	uri := fmt.Sprintf("%s://%s/%s", self.proto, storeAddr, path)
 
-	// if insecure is false, verify cert
-	if config.Insecure {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	}
-
 	req, err := http.NewRequest(method, uri, body)
 	if err != nil {
 		panic(err)
 	}
 	req.Header.Add("X-AUTH-TOKEN", config.StoreToken)
-	res, err := client.Do(req)
+	res, err := self.client.Do(req)
 	if err != nil {
 		// return original error to client
 		return nil, err
 	}
 	if res.StatusCode == 401 {
-		return nil, fmt.Errorf("401 Unauthorized. Please specify backend api token (-T 'backend-token')")
+		res.Body.Close()
+		return nil, statusError{"401 Unauthorized. Please specify backend api token (-T 'backend-token')"}
 	}
 	return res, nil
 }
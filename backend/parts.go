@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/metrics"
+)
+
+// partWriter is implemented by backends that can store a blob in parts,
+// uploaded at once and assembled into the blob when all are stored. Blobs are
+// written to other backends in a single stream.
+type partWriter interface {
+	startParts(id string) (string, error) // returns the upload's id
+	writePart(id, upload string, n int, part io.Reader, size int64) (string, error)
+	assembleParts(id, upload string, parts []string) error
+	abortParts(id, upload string, parts int)
+}
+
+// how often a part is tried before the upload fails, and how long to wait
+// before trying it again (multiplied by the attempts so far)
+const partAttempts = 3
+
+var partBackoff = time.Second
+
+// WriteBlobAt writes a blob of size bytes read from r. A blob larger than
+// config.PartSize is uploaded in parts, config.PartUploads at a time, if the
+// backend can assemble them. A failed part is retried on its own.
+func WriteBlobAt(requestId, id string, r io.ReaderAt, size int64) error {
+	partSize := config.PartSize
+	pw, ok := backend.(partWriter)
+	if !ok || partSize <= 0 || size <= partSize {
+		return write(requestId, id, io.NewSectionReader(r, 0, size))
+	}
+
+	// a failed part or assembly is counted on its own
+	start := time.Now()
+	err := writeParts(pw, requestId, id, r, size, partSize)
+	if err != nil {
+		observe(requestId, "write", id, start, uncounted{err})
+		return err
+	}
+	observe(requestId, "write", id, start, nil)
+	return nil
+}
+
+// writeParts uploads a blob in parts and assembles it, aborting the upload if
+// a part can't be written.
+func writeParts(pw partWriter, requestId, id string, r io.ReaderAt, size, partSize int64) error {
+	upload, err := pw.startParts(id)
+	if err != nil {
+		return err
+	}
+
+	count := int((size + partSize - 1) / partSize)
+	parts := make([]string, count)
+	errs := make(chan error, count)
+
+	workers := config.PartUploads
+	if workers < 1 {
+		workers = 1
+	}
+
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				off := int64(n) * partSize
+				length := partSize
+				if off+length > size {
+					length = size - off
+				}
+
+				tag, err := writePart(pw, requestId, id, upload, n+1, r, off, length)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				parts[n] = tag
+			}
+		}()
+	}
+
+	// stop handing out parts once one fails
+	var failed error
+feed:
+	for n := 0; n < count; n++ {
+		select {
+		case next <- n:
+		case failed = <-errs:
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if failed == nil && len(errs) > 0 {
+		failed = <-errs
+	}
+	if failed != nil {
+		pw.abortParts(id, upload, count)
+		return failed
+	}
+
+	start := time.Now()
+	err = pw.assembleParts(id, upload, parts)
+	observe(requestId, "assemble", id, start, err)
+	if err != nil {
+		pw.abortParts(id, upload, count)
+	}
+	return err
+}
+
+// writePart uploads part n of a blob, trying again if the backend fails. The
+// blob failing to be read isn't retried.
+func writePart(pw partWriter, requestId, id, upload string, n int, r io.ReaderAt, off, length int64) (string, error) {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		src := &sourceReader{Reader: io.NewSectionReader(r, off, length)}
+		tag, err := pw.writePart(id, upload, n, meteredReader{src, metrics.BackendWritten}, length)
+		if src.err != nil {
+			observe(requestId, "part", id, start, uncounted{src.err})
+			return "", src.err
+		}
+		observe(requestId, "part", id, start, err)
+		if err == nil {
+			return tag, nil
+		}
+
+		if attempt == partAttempts {
+			return "", fmt.Errorf("Failed to write part %d - %v", n, err)
+		}
+		config.Log.Debug("Retrying part %d of '%v' - %v", n, id, err)
+		time.Sleep(time.Duration(attempt) * partBackoff)
+	}
+}
+
+// newUpload generates an id keeping the parts of concurrent uploads apart
+func newUpload() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), err
+}
+
+// partName is the blob a part is stored under until it's assembled
+func partName(id, upload string, n int) string {
+	return fmt.Sprintf("%v.part-%v-%d", id, upload, n)
+}
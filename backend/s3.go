@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/nanobox-io/slurp/config"
+)
+
+type s3 struct {
+	client *minio.Client
+	bucket string
+}
+
+// newS3 creates an s3 client for the endpoint, credentials and bucket
+// described by 's3[+http]://access-key:secret-key@host:port/bucket?region=r'.
+// The store token is used as secret key if the url carries none.
+func newS3(u *url.URL, secure bool) (*s3, error) {
+	bucket := strings.Trim(u.Path, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("Missing bucket in storage address")
+	}
+
+	access := u.User.Username()
+	secret, ok := u.User.Password()
+	if !ok {
+		secret = config.StoreToken
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// if insecure is false, verify cert
+	if config.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:     credentials.NewStaticV4(access, secret, ""),
+		Secure:    secure,
+		Region:    u.Query().Get("region"),
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3{client: client, bucket: bucket}, nil
+}
+
+// ensure the bucket exists, creating it if needed
+func (self s3) initialize() error {
+	config.Log.Trace("[client] - HEAD s3/%v", self.bucket)
+	exists, err := self.client.BucketExists(context.Background(), self.bucket)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	config.Log.Trace("[client] - PUT s3/%v", self.bucket)
+	return self.client.MakeBucket(context.Background(), self.bucket, minio.MakeBucketOptions{})
+}
+
+// get blob from s3 and return Reader for piping to next command
+func (self s3) readBlob(id string) (io.ReadCloser, error) {
+	config.Log.Trace("[client] - GET s3/%v/%v", self.bucket, id)
+	obj, err := self.client.GetObject(context.Background(), self.bucket, id, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, stat to surface a missing blob now
+	_, err = obj.Stat()
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		obj.Close()
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// pipe blob to s3, the unknown length makes this a multipart upload
+func (self s3) writeBlob(id string, blob io.Reader) error {
+	config.Log.Trace("[client] - PUT s3/%v/%v", self.bucket, id)
+	_, err := self.client.PutObject(context.Background(), self.bucket, id, blob, -1, minio.PutObjectOptions{})
+	return err
+}
+
+// start a multipart upload
+func (self s3) startParts(id string) (string, error) {
+	config.Log.Trace("[client] - POST s3/%v/%v?uploads", self.bucket, id)
+	return minio.Core{Client: self.client}.NewMultipartUpload(context.Background(), self.bucket, id, minio.PutObjectOptions{})
+}
+
+// upload a part, returning its etag. The payload is left unsigned, not every s3
+// compatible store decodes the streaming signature of a part.
+func (self s3) writePart(id, upload string, n int, part io.Reader, size int64) (string, error) {
+	config.Log.Trace("[client] - PUT s3/%v/%v?partNumber=%d", self.bucket, id, n)
+	opts := minio.PutObjectPartOptions{DisableContentSha256: true}
+	info, err := minio.Core{Client: self.client}.PutObjectPart(context.Background(), self.bucket, id, upload, n, part, size, opts)
+	return info.ETag, err
+}
+
+// complete a multipart upload from the etags of its parts
+func (self s3) assembleParts(id, upload string, parts []string) error {
+	config.Log.Trace("[client] - POST s3/%v/%v?uploadId=%v", self.bucket, id, upload)
+	complete := make([]minio.CompletePart, len(parts))
+	for i, etag := range parts {
+		complete[i] = minio.CompletePart{PartNumber: i + 1, ETag: etag}
+	}
+	_, err := minio.Core{Client: self.client}.CompleteMultipartUpload(context.Background(), self.bucket, id, upload, complete, minio.PutObjectOptions{})
+	return err
+}
+
+// abort a multipart upload, dropping its parts
+func (self s3) abortParts(id, upload string, parts int) {
+	config.Log.Trace("[client] - DELETE s3/%v/%v?uploadId=%v", self.bucket, id, upload)
+	minio.Core{Client: self.client}.AbortMultipartUpload(context.Background(), self.bucket, id, upload)
+}
+
+// check for blob in s3
+func (self s3) hasBlob(id string) (bool, error) {
+	config.Log.Trace("[client] - HEAD s3/%v/%v", self.bucket, id)
+	_, err := self.client.StatObject(context.Background(), self.bucket, id, minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,61 @@
+// Package "buildid" defines the build ids slurp accepts. A build id names the
+// build's stage directory, its ssh user and its blobs, so it is checked before
+// it is used for any of them.
+package buildid
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxLength is the longest build id accepted
+const MaxLength = 128
+
+// reserved is the suffix of the blobs build manifests are stored under
+const reserved = ".manifest"
+
+// Error describes why a build id was refused
+type Error struct {
+	Id     string
+	Reason string
+}
+
+func (self Error) Error() string {
+	return fmt.Sprintf("Invalid build id %q - %v", self.Id, self.Reason)
+}
+
+// Validate checks id against the build id grammar:
+//
+//	id = alnum *( alnum / "." / "_" / "-" )
+//
+// at most MaxLength long and not ending in ".manifest". An id can't be empty,
+// hold a slash or start with a dot, so it can't name anything outside of the
+// build dir nor one of slurp's own files in it.
+func Validate(id string) error {
+	if id == "" {
+		return Error{id, "it is empty"}
+	}
+	if len(id) > MaxLength {
+		return Error{id, fmt.Sprintf("it is longer than %d characters", MaxLength)}
+	}
+	if !alnum(id[0]) {
+		return Error{id, "it must start with a letter or digit"}
+	}
+
+	for i := 1; i < len(id); i++ {
+		if !alnum(id[i]) && id[i] != '.' && id[i] != '_' && id[i] != '-' {
+			return Error{id, fmt.Sprintf("%q isn't allowed", id[i])}
+		}
+	}
+
+	if strings.HasSuffix(id, reserved) {
+		return Error{id, fmt.Sprintf("the %q suffix is reserved", reserved)}
+	}
+
+	return nil
+}
+
+// alnum reports whether c is an ascii letter or digit
+func alnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
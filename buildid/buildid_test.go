@@ -0,0 +1,26 @@
+package buildid_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nanobox-io/slurp/buildid"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []string{"abc123", "app-build_2.1", "B", strings.Repeat("a", buildid.MaxLength)}
+	for _, id := range valid {
+		err := buildid.Validate(id)
+		if err != nil {
+			t.Errorf("'%v' refused - %v", id, err)
+		}
+	}
+
+	invalid := []string{"", ".", "..", "../../etc", "a/b", ".stages.json", "-rf", "a b", "app.manifest", "lost+found", strings.Repeat("a", buildid.MaxLength+1)}
+	for _, id := range invalid {
+		err := buildid.Validate(id)
+		if _, ok := err.(buildid.Error); !ok {
+			t.Errorf("'%v' accepted - %v", id, err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ package config
 import (
 	"fmt"
 	"path/filepath"
+	"time"
 
 	"github.com/jcelliott/lumber"
 	"github.com/spf13/cobra"
@@ -12,17 +13,32 @@ import (
 )
 
 var (
-	ApiToken   = "secret"                    // Token for API Access
-	ApiAddress = "https://127.0.0.1:1566"    // Listen uri for the API (scheme defaults to https)
-	BuildDir   = "/var/db/slurp/build/"      // Build staging directory
-	ConfigFile = ""                          // Configuration file to load
-	Insecure   = true                        // Disable tls key checking to hoarder
-	LogLevel   = "info"                      // Log level to output [fatal|error|info|debug|trace]
-	SshAddr    = "127.0.0.1:1567"            // Address ssh server will listen on (ip:port combo)
-	SshHostKey = "/var/db/slurp/slurp_rsa"   // SSH host (private) key file
-	StoreAddr  = "hoarders://127.0.0.1:7410" // Storage host address
-	StoreToken = ""                          // Storage auth token
-	Version    = false                       // Print version info and exit
+	ApiToken        = "secret"                    // Token for API Access
+	ApiAddress      = "https://127.0.0.1:1566"    // Listen uri for the API (scheme defaults to https)
+	AuditLog        = "/var/db/slurp/audit.log"   // Append-only log of the builds created, committed and deleted (empty to disable)
+	BuildDir        = "/var/db/slurp/build/"      // Build staging directory
+	CacheDir        = "/var/db/slurp/cache/"      // Directory to cache recent builds in
+	CacheSize       = int64(5 << 30)              // Bytes of builds to cache (0 to disable)
+	Codec           = "gzip"                      // Compression codec for builds [gzip|zstd|none], with an optional level (gzip:1-9, zstd:1-22)
+	CommitQueue     = 32                          // Commits that may wait for a worker before more are refused
+	CommitWorkers   = 2                           // Commits compressed and uploaded at once
+	ConfigFile      = ""                          // Configuration file to load
+	DeltaDepth      = 0                           // Longest chain of delta builds before a full one is stored (0 to always store full builds)
+	EmbeddedRsync   = false                       // Receive pushes in process rather than with the system rsync
+	Insecure        = true                        // Disable tls key checking to hoarder
+	LogFormat       = "text"                      // Format of request logs [text|json]
+	LogLevel        = "info"                      // Log level to output [fatal|error|info|debug|trace]
+	MinFree         = int64(0)                    // Bytes that must be free in the build dir to add a stage (0 to disable)
+	PartSize        = int64(64 << 20)             // Bytes per part of multi-part uploads (0 to upload in one stream)
+	PartUploads     = 4                           // Parts of a multi-part upload in flight at once
+	ShutdownTimeout = time.Minute                 // How long to wait for rsync sessions and commits on shutdown
+	SshAddr         = "127.0.0.1:1567"            // Address ssh server will listen on (ip:port combo)
+	SshHostKey      = "/var/db/slurp/slurp_rsa"   // SSH host (private) key file
+	StageQuota      = int64(0)                    // Bytes a stage may hold, enforced while it is synced to (0 for no limit)
+	StageTTL        = 24 * time.Hour              // Idle time before a stage is removed (0 to keep forever)
+	StoreAddr       = "hoarders://127.0.0.1:7410" // Storage address [hoarder[s]://|file://|s3[+http]://]
+	StoreToken      = ""                          // Storage auth token
+	Version         = false                       // Print version info and exit
 
 	Log lumber.Logger // Central logger for slurp
 )
@@ -31,14 +47,29 @@ var (
 func AddFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().StringVarP(&ApiToken, "api-token", "t", ApiToken, "Token for API Access")
 	cmd.PersistentFlags().StringVarP(&ApiAddress, "api-address", "a", ApiAddress, "Listen uri for the API (scheme defaults to https)")
+	cmd.PersistentFlags().StringVar(&AuditLog, "audit-log", AuditLog, "Append-only log of the builds created, committed and deleted (empty to disable)")
 	cmd.PersistentFlags().StringVarP(&BuildDir, "build-dir", "b", BuildDir, "Build staging directory")
+	cmd.PersistentFlags().StringVar(&CacheDir, "cache-dir", CacheDir, "Directory to cache recent builds in")
+	cmd.PersistentFlags().Int64Var(&CacheSize, "cache-size", CacheSize, "Bytes of builds to cache (0 to disable)")
+	cmd.PersistentFlags().StringVar(&Codec, "codec", Codec, "Compression codec for builds [gzip|zstd|none], with an optional level (gzip:1-9, zstd:1-22)")
+	cmd.PersistentFlags().IntVar(&CommitQueue, "commit-queue", CommitQueue, "Commits that may wait for a worker before more are refused")
+	cmd.PersistentFlags().IntVar(&CommitWorkers, "commit-workers", CommitWorkers, "Commits compressed and uploaded at once")
+	cmd.PersistentFlags().IntVar(&DeltaDepth, "delta-depth", DeltaDepth, "Longest chain of delta builds before a full one is stored (0 to always store full builds)")
+	cmd.PersistentFlags().BoolVar(&EmbeddedRsync, "embedded-rsync", EmbeddedRsync, "Receive pushes in process rather than with the system rsync")
+	cmd.PersistentFlags().DurationVar(&ShutdownTimeout, "shutdown-timeout", ShutdownTimeout, "How long to wait for rsync sessions and commits on shutdown")
+	cmd.PersistentFlags().Int64Var(&StageQuota, "stage-quota", StageQuota, "Bytes a stage may hold, enforced while it is synced to (0 for no limit)")
+	cmd.PersistentFlags().DurationVar(&StageTTL, "stage-ttl", StageTTL, "Idle time before a stage is removed (0 to keep forever)")
 	cmd.PersistentFlags().BoolVarP(&Insecure, "insecure", "i", Insecure, "Disable tls certificate verification when connecting to storage")
+	cmd.PersistentFlags().StringVar(&LogFormat, "log-format", LogFormat, "Format of request logs [text|json]")
 	cmd.PersistentFlags().StringVarP(&LogLevel, "log-level", "l", LogLevel, "Log level to output [fatal|error|info|debug|trace]")
+	cmd.PersistentFlags().Int64Var(&MinFree, "min-free", MinFree, "Bytes that must be free in the build dir to add a stage (0 to disable)")
+	cmd.PersistentFlags().Int64Var(&PartSize, "part-size", PartSize, "Bytes per part of multi-part uploads (0 to upload in one stream)")
+	cmd.PersistentFlags().IntVar(&PartUploads, "part-uploads", PartUploads, "Parts of a multi-part upload in flight at once")
 
 	cmd.PersistentFlags().StringVarP(&SshAddr, "ssh-addr", "s", SshAddr, "Address ssh server will listen on (ip:port combo)")
 	cmd.PersistentFlags().StringVarP(&SshHostKey, "ssh-host", "k", SshHostKey, "SSH host (private) key file")
 
-	cmd.PersistentFlags().StringVarP(&StoreAddr, "store-addr", "S", StoreAddr, "Storage host address")
+	cmd.PersistentFlags().StringVarP(&StoreAddr, "store-addr", "S", StoreAddr, "Storage address [hoarder[s]://|file://|s3[+http]://]")
 	cmd.PersistentFlags().StringVarP(&StoreToken, "store-token", "T", StoreToken, "Storage auth token")
 
 	cmd.PersistentFlags().StringVarP(&ConfigFile, "config-file", "c", ConfigFile, "Configuration file to load")
@@ -54,9 +85,24 @@ func LoadConfigFile() error {
 	// Set defaults to whatever might be there already
 	viper.SetDefault("api-token", ApiToken)
 	viper.SetDefault("api-address", ApiAddress)
+	viper.SetDefault("audit-log", AuditLog)
 	viper.SetDefault("build-dir", BuildDir)
+	viper.SetDefault("cache-dir", CacheDir)
+	viper.SetDefault("cache-size", CacheSize)
+	viper.SetDefault("codec", Codec)
+	viper.SetDefault("commit-queue", CommitQueue)
+	viper.SetDefault("commit-workers", CommitWorkers)
+	viper.SetDefault("delta-depth", DeltaDepth)
+	viper.SetDefault("embedded-rsync", EmbeddedRsync)
+	viper.SetDefault("shutdown-timeout", ShutdownTimeout)
+	viper.SetDefault("stage-quota", StageQuota)
+	viper.SetDefault("stage-ttl", StageTTL)
 	viper.SetDefault("insecure", Insecure)
+	viper.SetDefault("log-format", LogFormat)
 	viper.SetDefault("log-level", LogLevel)
+	viper.SetDefault("min-free", MinFree)
+	viper.SetDefault("part-size", PartSize)
+	viper.SetDefault("part-uploads", PartUploads)
 	viper.SetDefault("ssh-addr", SshAddr)
 	viper.SetDefault("ssh-host", SshHostKey)
 	viper.SetDefault("store-addr", StoreAddr)
@@ -74,9 +120,24 @@ func LoadConfigFile() error {
 	// Set values. Config file will override commandline
 	ApiToken = viper.GetString("api-token")
 	ApiAddress = viper.GetString("api-address")
+	AuditLog = viper.GetString("audit-log")
 	BuildDir = viper.GetString("build-dir")
+	CacheDir = viper.GetString("cache-dir")
+	CacheSize = viper.GetInt64("cache-size")
+	Codec = viper.GetString("codec")
+	CommitQueue = viper.GetInt("commit-queue")
+	CommitWorkers = viper.GetInt("commit-workers")
+	DeltaDepth = viper.GetInt("delta-depth")
+	EmbeddedRsync = viper.GetBool("embedded-rsync")
+	ShutdownTimeout = viper.GetDuration("shutdown-timeout")
+	StageQuota = viper.GetInt64("stage-quota")
+	StageTTL = viper.GetDuration("stage-ttl")
 	Insecure = viper.GetBool("insecure")
+	LogFormat = viper.GetString("log-format")
 	LogLevel = viper.GetString("log-level")
+	MinFree = viper.GetInt64("min-free")
+	PartSize = viper.GetInt64("part-size")
+	PartUploads = viper.GetInt("part-uploads")
 	SshAddr = viper.GetString("ssh-addr")
 	SshHostKey = viper.GetString("ssh-host")
 	StoreAddr = viper.GetString("store-addr")
@@ -0,0 +1,320 @@
+package slurp
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nanobox-io/slurp/config"
+)
+
+// modeBits are the mode bits restored on extracted files
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// compress writes the contents of dir to w as a tarball compressed with c,
+// adding the bytes of file content read to progress and each entry to
+// manifest. If only is set, just those entries (and the root) are archived.
+// Entries are written in lexical order and the gzip header carries no name or
+// timestamp (what `GZIP=-n` did for tar), so identical trees compress
+// identically.
+func compress(dir string, w io.Writer, c codec, progress *int64, manifest *Manifest, only map[string]bool) error {
+	zw, err := c.compressor(w)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// tar doesn't archive sockets either
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		// directories left out are still walked
+		if only != nil && rel != "." && !only[filepath.ToSlash(rel)] {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		// match `tar -C dir -czf - .` naming
+		hdr.Name = "./" + filepath.ToSlash(rel)
+		if rel == "." {
+			hdr.Name = "./"
+		} else if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		// access and change times differ between otherwise identical trees
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		entry := newManifestEntry(filepath.ToSlash(rel), info, link)
+		if !info.Mode().IsRegular() {
+			// the build root isn't one of its files
+			if rel != "." {
+				manifest.Files = append(manifest.Files, entry)
+			}
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(tw, hash), countReader{file, progress})
+		entry.Sha256 = hex.EncodeToString(hash.Sum(nil))
+		manifest.Files = append(manifest.Files, entry)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// extract unpacks the tarball compressed with the codec named name read from r
+// into dir, restoring modes and modification times (and ownership when running
+// as root).
+func extract(r io.Reader, dir, name string) error {
+	zr, err := decompressor(name, r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	return untar(zr, dir, 0)
+}
+
+// ArchiveError is an archive that couldn't be extracted because it's
+// malformed or cut short, rather than for want of somewhere to extract it.
+type ArchiveError struct {
+	Err error
+}
+
+func (self ArchiveError) Error() string {
+	return "Bad archive - " + self.Err.Error()
+}
+
+// archiveReader reads an archive, keeping any error reading it
+type archiveReader struct {
+	io.Reader
+	err error
+}
+
+func (self *archiveReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		self.err = err
+	}
+	return n, err
+}
+
+// extractAny unpacks a tarball read from r into dir, gzipped, zstd compressed
+// or not compressed at all, stopping with ErrQuota past limit bytes of files.
+func extractAny(r io.Reader, dir string, limit int64) error {
+	br := bufio.NewReader(r)
+	zr, err := decompressor(sniffCodec(br), br)
+	if err != nil {
+		return ArchiveError{err}
+	}
+	defer zr.Close()
+
+	return untar(zr, dir, limit)
+}
+
+// untar unpacks the tarball read from r into dir. With a limit above 0, it
+// stops with ErrQuota before the files it writes add up to more. Failing to
+// read the tarball, or an entry landing outside of dir, is an ArchiveError.
+func untar(r io.Reader, dir string, limit int64) error {
+	tr := tar.NewReader(r)
+	var written int64
+
+	// directory times are set last, writing their contents would change them
+	var dirs []*tar.Header
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ArchiveError{err}
+		}
+
+		path, err := extractPath(dir, hdr.Name)
+		if err != nil {
+			return ArchiveError{err}
+		}
+
+		mode := hdr.FileInfo().Mode() & modeBits
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// a directory replaces a symlink rather than being made through it
+			if info, lerr := os.Lstat(path); lerr == nil && !info.IsDir() {
+				os.Remove(path)
+			}
+			err = os.MkdirAll(path, 0755)
+			if err == nil {
+				err = os.Chmod(path, mode)
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			written += hdr.Size
+			if limit > 0 && written > limit {
+				return ErrQuota
+			}
+			src := &archiveReader{Reader: tr}
+			err = extractFile(src, path, mode)
+			if src.err != nil {
+				return ArchiveError{fmt.Errorf("Failed to extract '%v' - %v", hdr.Name, src.err)}
+			}
+		case tar.TypeSymlink:
+			os.Remove(path)
+			err = os.Symlink(hdr.Linkname, path)
+		case tar.TypeLink:
+			var target string
+			target, err = extractPath(dir, hdr.Linkname)
+			if err != nil {
+				return ArchiveError{err}
+			}
+			os.Remove(path)
+			err = os.Link(target, path)
+		default:
+			config.Log.Trace("Skipping '%v', unsupported type '%c'", hdr.Name, hdr.Typeflag)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to extract '%v' - %v", hdr.Name, err)
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		extractAttrs(path, hdr)
+	}
+
+	// a later entry may have replaced a directory, with a symlink even
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path, err := extractPath(dir, dirs[i].Name)
+		if err != nil {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		extractAttrs(path, dirs[i])
+	}
+
+	return nil
+}
+
+// extractPath resolves an archive entry name to a path within dir, refusing
+// entries that would land outside of it, directly or through a symlink.
+func extractPath(dir, name string) (string, error) {
+	dir = filepath.Clean(dir)
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("Archive entry '%v' escapes build dir", name)
+	}
+
+	for parent := filepath.Dir(path); len(parent) > len(dir); parent = filepath.Dir(parent) {
+		info, err := os.Lstat(parent)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Archive entry '%v' is beneath a symlink", name)
+		}
+	}
+
+	return path, nil
+}
+
+// extractFile writes a regular file's contents from the archive.
+func extractFile(r io.Reader, path string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// replace rather than truncate, the path may be a hardlink
+	os.Remove(path)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// the umask may have masked the requested mode
+	return os.Chmod(path, mode)
+}
+
+// extractAttrs restores ownership and modification time. Failures are logged,
+// tar only warns about them as well.
+func extractAttrs(path string, hdr *tar.Header) {
+	if os.Geteuid() == 0 {
+		err := os.Lchown(path, hdr.Uid, hdr.Gid)
+		if err != nil {
+			config.Log.Trace("Failed to restore owner of '%v' - %v", hdr.Name, err)
+		}
+	}
+
+	// symlink times can't be set portably
+	if hdr.Typeflag == tar.TypeSymlink {
+		return
+	}
+
+	err := os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+	if err != nil {
+		config.Log.Trace("Failed to restore mtime of '%v' - %v", hdr.Name, err)
+	}
+}
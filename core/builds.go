@@ -0,0 +1,155 @@
+package slurp
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/nanobox-io/slurp/backend"
+	"github.com/nanobox-io/slurp/buildid"
+	"github.com/nanobox-io/slurp/config"
+)
+
+// returned when a stored build holds no such file
+var ErrFileNotFound = errors.New("No File Found")
+
+// buildFile is a file streamed out of a stored build, closing the decompressor
+// and blob once read
+type buildFile struct {
+	io.Reader
+	zr   io.Closer
+	blob io.Closer
+}
+
+func (self buildFile) Close() error {
+	self.zr.Close()
+	return self.blob.Close()
+}
+
+// ReadBuild streams a stored build as a tarball, along with the name of the
+// codec it is compressed with. A delta is rebuilt from its chain and compressed
+// again with the codec of its newest build, a full build is streamed as stored.
+// Backend requests are logged under requestId.
+func ReadBuild(buildId, requestId string) (io.ReadCloser, string, error) {
+	err := buildid.Validate(buildId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ref, err := backend.ReadRef(requestId, buildId)
+	if err == backend.ErrNotFound {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read build - %v", err)
+	}
+
+	// a plain tarball, or stored before codecs were recorded
+	name := CodecGzip
+	if ref != nil && ref.Codec != "" {
+		name = ref.Codec
+	}
+
+	if ref == nil || ref.Parent == nil {
+		blob, err := backend.ReadBlob(requestId, buildId)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to read build - %v", err)
+		}
+		return blob, name, nil
+	}
+
+	dir, err := ioutil.TempDir(config.BuildDir, ".build-")
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to create rebuild dir - %v", err)
+	}
+	err = applyRef(ref, dir, requestId)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", fmt.Errorf("Failed to rebuild build - %v", err)
+	}
+
+	// closing the reader early fails the compression, which cleans up
+	pr, pw := io.Pipe()
+	go func() {
+		var progress int64
+		err := compress(dir, pw, codec{name: name}, &progress, &Manifest{}, nil)
+		os.RemoveAll(dir)
+		pw.CloseWithError(err)
+	}()
+
+	return pr, name, nil
+}
+
+// ReadBuildFile streams the regular file name out of a stored build, along
+// with its size. The archive is read up to the file, nothing is extracted. For
+// a delta, the newest build in the chain holding the file is read from.
+func ReadBuildFile(buildId, name, requestId string) (io.ReadCloser, int64, error) {
+	err := buildid.Validate(buildId)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ref, err := backend.ReadRef(requestId, buildId)
+	if err == backend.ErrNotFound {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to read build - %v", err)
+	}
+
+	name = path.Clean("/" + name)
+
+	// a plain tarball
+	if ref == nil {
+		return findFile(buildId, CodecGzip, name, requestId)
+	}
+
+	for ; ref != nil; ref = ref.Parent {
+		file, size, err := findFile(ref.Blob, ref.Codec, name, requestId)
+		if err != ErrFileNotFound || deletedIn(ref, name[1:]) {
+			return file, size, err
+		}
+	}
+
+	return nil, 0, ErrFileNotFound
+}
+
+// findFile streams the regular file name out of the archive stored as id,
+// compressed with the codec named codecName.
+func findFile(id, codecName, name, requestId string) (io.ReadCloser, int64, error) {
+	blob, err := backend.ReadBlob(requestId, id)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to read build - %v", err)
+	}
+
+	zr, err := decompressor(codecName, blob)
+	if err != nil {
+		blob.Close()
+		return nil, 0, fmt.Errorf("Failed to read build - %v", err)
+	}
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			zr.Close()
+			blob.Close()
+			return nil, 0, fmt.Errorf("Failed to read build - %v", err)
+		}
+
+		if path.Clean("/"+hdr.Name) == name && hdr.Typeflag == tar.TypeReg {
+			return buildFile{tr, zr, blob}, hdr.Size, nil
+		}
+	}
+
+	zr.Close()
+	blob.Close()
+	return nil, 0, ErrFileNotFound
+}
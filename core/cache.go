@@ -0,0 +1,313 @@
+package slurp
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/dirsize"
+	"github.com/nanobox-io/slurp/metrics"
+)
+
+// cacheEntry is a build tree kept in config.CacheDir. The tree lives in
+// CacheDir/<id>/tree, the mtime of CacheDir/<id> records when it was last
+// used (the tree's own times are part of the build).
+type cacheEntry struct {
+	id   string
+	size int64
+	used time.Time
+}
+
+var (
+	// cached build trees, keyed by build id
+	cache = map[string]*cacheEntry{}
+
+	// cacheMutex ensures updates to cache are atomic
+	cacheMutex = sync.Mutex{}
+
+	cacheHits   int64 // stages seeded from the cache
+	cacheMisses int64 // stages seeded from the backend
+)
+
+// CacheStats returns how many stages were seeded from the cache (hits) and
+// how many had to fetch their old build from the backend (misses).
+func CacheStats() (hits, misses int64) {
+	return atomic.LoadInt64(&cacheHits), atomic.LoadInt64(&cacheMisses)
+}
+
+// initCache rebuilds the cache index from the contents of config.CacheDir.
+func initCache() error {
+	if config.CacheSize <= 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(config.CacheDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create cache dir - %v", err)
+	}
+
+	dirs, err := ioutil.ReadDir(config.CacheDir)
+	if err != nil {
+		return fmt.Errorf("Failed to list cache dir - %v", err)
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cache = map[string]*cacheEntry{}
+	for _, dir := range dirs {
+		path := filepath.Join(config.CacheDir, dir.Name())
+
+		// partial entries of a cut off run
+		if strings.HasPrefix(dir.Name(), ".") {
+			os.RemoveAll(path)
+			continue
+		}
+
+		cache[dir.Name()] = &cacheEntry{id: dir.Name(), size: dirsize.Of(path), used: dir.ModTime()}
+	}
+
+	evict()
+
+	config.Log.Debug("Restored %d cached build(s)", len(cache))
+
+	return nil
+}
+
+// cacheFetch seeds dst with the cached tree of build id, if there is one.
+func cacheFetch(id, dst string) bool {
+	if config.CacheSize <= 0 {
+		return false
+	}
+
+	cacheMutex.Lock()
+	entry, ok := cache[id]
+	if ok {
+		// mark it used before letting go, so it isn't evicted mid copy
+		entry.used = time.Now()
+		os.Chtimes(filepath.Join(config.CacheDir, id), entry.used, entry.used)
+	}
+	cacheMutex.Unlock()
+
+	if ok {
+		err := cloneTree(filepath.Join(config.CacheDir, id, "tree"), dst)
+		if err == nil {
+			atomic.AddInt64(&cacheHits, 1)
+			metrics.CacheLookups.WithLabelValues("hit").Inc()
+			config.Log.Debug("Cache hit for '%v'", id)
+			return true
+		}
+
+		// an unusable entry is dropped, the backend has the build
+		config.Log.Error("Failed to copy cached build '%v' - %v", id, err)
+		cacheMutex.Lock()
+		if cache[id] == entry {
+			delete(cache, id)
+			os.RemoveAll(filepath.Join(config.CacheDir, id))
+		}
+		cacheMutex.Unlock()
+
+		// leave dst empty for the fetch
+		os.RemoveAll(dst)
+		os.MkdirAll(dst, 0755)
+	}
+
+	atomic.AddInt64(&cacheMisses, 1)
+	metrics.CacheLookups.WithLabelValues("miss").Inc()
+	config.Log.Debug("Cache miss for '%v'", id)
+	return false
+}
+
+// cacheStore copies the tree of build id at src into the cache, evicting the
+// least recently used builds to stay within config.CacheSize. Failures only
+// cost a later cache miss, so they are logged rather than returned.
+func cacheStore(id, src string) {
+	if config.CacheSize <= 0 {
+		return
+	}
+
+	err := os.MkdirAll(config.CacheDir, 0755)
+	if err != nil {
+		config.Log.Error("Failed to create cache dir - %v", err)
+		return
+	}
+
+	// copy beside the cache, then swap it in
+	tmp, err := ioutil.TempDir(config.CacheDir, "."+id+"-")
+	if err != nil {
+		config.Log.Error("Failed to cache build '%v' - %v", id, err)
+		return
+	}
+
+	err = cloneTree(src, filepath.Join(tmp, "tree"))
+	if err != nil {
+		os.RemoveAll(tmp)
+		config.Log.Error("Failed to cache build '%v' - %v", id, err)
+		return
+	}
+
+	entry := &cacheEntry{id: id, size: dirsize.Of(tmp), used: time.Now()}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	path := filepath.Join(config.CacheDir, id)
+	os.RemoveAll(path)
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.RemoveAll(tmp)
+		delete(cache, id)
+		config.Log.Error("Failed to cache build '%v' - %v", id, err)
+		return
+	}
+
+	cache[id] = entry
+	config.Log.Trace("Cached build '%v' (%d bytes)", id, entry.size)
+
+	evict()
+}
+
+// evict removes the least recently used builds until the cache fits in
+// config.CacheSize. The caller must hold cacheMutex.
+func evict() {
+	var total int64
+	entries := make([]*cacheEntry, 0, len(cache))
+	for _, entry := range cache {
+		total += entry.size
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+
+	for _, entry := range entries {
+		if total <= config.CacheSize {
+			break
+		}
+
+		config.Log.Trace("Evicting cached build '%v'", entry.id)
+		os.RemoveAll(filepath.Join(config.CacheDir, entry.id))
+		delete(cache, entry.id)
+		total -= entry.size
+	}
+}
+
+// cloneTree copies the tree at src to dst, sharing file data through reflinks
+// where the filesystem allows. Files are never hardlinked: stages are written
+// to in place (a chmod, an sftp write), which would reach the cache too.
+func cloneTree(src, dst string) error {
+	// directory times are set last, filling them would change them
+	var dirs []string
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			err = os.MkdirAll(target, 0755)
+			if err == nil {
+				err = os.Chmod(target, info.Mode()&modeBits)
+			}
+			dirs = append(dirs, rel)
+		case info.Mode().IsRegular():
+			os.Remove(target)
+			err = cloneFile(path, target, info)
+		case info.Mode()&os.ModeSymlink != 0:
+			var link string
+			link, err = os.Readlink(path)
+			if err == nil {
+				os.Remove(target)
+				err = os.Symlink(link, target)
+			}
+		default:
+			// devices, fifos and sockets aren't part of builds
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			copyAttrs(target, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err == nil {
+			copyAttrs(filepath.Join(dst, dirs[i]), info)
+		}
+	}
+
+	return nil
+}
+
+// cloneFile makes dst share, or failing that copy, the data of src.
+func cloneFile(src, dst string, info os.FileInfo) error {
+	err := reflink(src, dst)
+	if err == nil {
+		return os.Chmod(dst, info.Mode()&modeBits)
+	}
+	os.Remove(dst)
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(dst, info.Mode()&modeBits)
+}
+
+// copyAttrs copies ownership and modification time from info to path.
+func copyAttrs(path string, info os.FileInfo) {
+	if os.Geteuid() == 0 {
+		// tar knows how to find the owner on every platform
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err == nil {
+			os.Lchown(path, hdr.Uid, hdr.Gid)
+		}
+	}
+
+	// symlink times can't be set portably
+	if info.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,123 @@
+package slurp
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// codecs builds can be compressed with. Refs record the name, a build stored
+// without one is gzipped.
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+	CodecNone = "none"
+)
+
+// codec is a compression codec and level, as configured with "name[:level]"
+type codec struct {
+	name  string
+	level int // 0 for the codec's default
+}
+
+// ParseCodec checks a codec spec: "gzip" (levels 1-9), "zstd" (levels 1-22)
+// or "none", optionally followed by ":level". The zstd encoder only has four
+// speeds, so zstd levels are mapped onto them: 1-2 fastest, 3-5 default, 6-9
+// better and 10-22 best.
+func ParseCodec(spec string) error {
+	_, err := parseCodec(spec)
+	return err
+}
+
+func parseCodec(spec string) (codec, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	c := codec{name: parts[0]}
+
+	max := 0
+	switch c.name {
+	case CodecGzip:
+		max = gzip.BestCompression
+	case CodecZstd:
+		max = 22
+	case CodecNone:
+	default:
+		return codec{}, fmt.Errorf("Unknown codec '%v'", c.name)
+	}
+
+	if len(parts) == 2 {
+		level, err := strconv.Atoi(parts[1])
+		if err != nil || level < 1 || level > max {
+			return codec{}, fmt.Errorf("Invalid level '%v' for codec '%v'", parts[1], c.name)
+		}
+		c.level = level
+	}
+
+	return c, nil
+}
+
+// compressor wraps w in the codec's encoder.
+func (self codec) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch self.name {
+	case CodecZstd:
+		level := zstd.SpeedDefault
+		if self.level != 0 {
+			// one of four speeds, see ParseCodec
+			level = zstd.EncoderLevelFromZstd(self.level)
+		}
+		// a single goroutine, so the same tree always compresses the same
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	case CodecNone:
+		return nopWriteCloser{w}, nil
+	}
+
+	level := gzip.DefaultCompression
+	if self.level != 0 {
+		level = self.level
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// decompressor wraps r in the decoder of the codec named name.
+func decompressor(name string, r io.Reader) (io.ReadCloser, error) {
+	switch name {
+	case CodecGzip, "":
+		return gzip.NewReader(r)
+	case CodecZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CodecNone:
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("Unknown codec '%v'", name)
+}
+
+// sniffCodec names the codec an archive read from br was compressed with,
+// going by its magic number.
+func sniffCodec(br *bufio.Reader) string {
+	magic, _ := br.Peek(4)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return CodecGzip
+	case len(magic) == 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+		return CodecZstd
+	}
+	return CodecNone
+}
+
+// nopWriteCloser leaves the writer it wraps open
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (self nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,277 @@
+package slurp
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/dirsize"
+	"github.com/nanobox-io/slurp/logs"
+	"github.com/nanobox-io/slurp/metrics"
+)
+
+// commit states
+const (
+	CommitQueued  = "queued"  // waiting for a worker
+	CommitRunning = "running" // compressing and uploading
+	CommitDone    = "done"    // stored in the backend and the stage removed
+	CommitFailed  = "failed"  // see the commit's error
+)
+
+// how long a finished commit can still be polled
+const commitRetention = time.Hour
+
+// Commit reports the progress of compressing and uploading a stage.
+type Commit struct {
+	Id         string    `json:"id"`         // what the commit is polled by, each commit of a build gets its own
+	Compressed int64     `json:"compressed"` // bytes of the build compressed so far
+	Uploaded   int64     `json:"uploaded"`   // compressed bytes written to the backend so far
+	Size       int64     `json:"size"`       // bytes of the build when the commit started
+	BuildId    string    `json:"build-id"`   // build being committed
+	Codec      string    `json:"codec"`      // codec the build is compressed with, and its level
+	State      string    `json:"state"`      // one of the Commit* constants
+	Error      string    `json:"error"`      // why the commit failed
+	Started    time.Time `json:"started"`    // when the commit was asked for
+	Finished   time.Time `json:"finished"`   // when the commit finished
+	Priority   int       `json:"priority"`   // queued commits with a higher one run first
+	Position   int       `json:"position"`   // place in the queue while queued, 1 runs next
+
+	// an identical build was already stored, nothing was uploaded
+	Deduplicated bool `json:"deduplicated"`
+
+	// only what changed since the stage's old build was stored
+	Delta bool `json:"delta"`
+
+	codec  codec
+	caller logs.Caller // who asked for the commit
+}
+
+var (
+	// commits in progress or recently finished, keyed by commit id
+	commits = map[string]*Commit{}
+
+	// commitMutex ensures updates to commits are atomic
+	commitMutex = sync.Mutex{}
+
+	// commits waiting for a worker, in the order they'll run
+	queue = []*Commit{}
+
+	// commits holding one of the config.CommitWorkers workers
+	working = 0
+
+	// signalled as workers free up, and when Drain aborts queued commits
+	workerFree = sync.NewCond(&commitMutex)
+
+	// returned when a build is already being committed
+	ErrCommitRunning = errors.New("Commit Already Running")
+
+	// returned when config.CommitQueue commits are already waiting
+	ErrQueueFull = errors.New("Commit Queue Is Full")
+)
+
+// GetCommit returns the progress of a commit, by the id it was started with.
+func GetCommit(id string) (Commit, error) {
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	commit, ok := commits[id]
+	if !ok {
+		return Commit{}, ErrNotFound
+	}
+
+	return commit.status(), nil
+}
+
+// startCommit registers a new commit of a build, pruning old finished ones. It
+// runs right away if a worker is free, and is queued behind commits of the
+// same or a higher priority otherwise.
+func startCommit(buildId, codecSpec string, priority int, caller logs.Caller) (*Commit, error) {
+	if codecSpec == "" {
+		codecSpec = config.Codec
+	}
+	c, err := parseCodec(codecSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	size := dirsize.Of(config.BuildDir + "/" + buildId)
+
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	for id, commit := range commits {
+		if !commit.active() && time.Since(commit.Finished) > commitRetention {
+			delete(commits, id)
+		}
+	}
+
+	if isDraining() {
+		return nil, ErrShuttingDown
+	}
+
+	for _, commit := range commits {
+		if commit.BuildId == buildId && commit.active() {
+			return nil, ErrCommitRunning
+		}
+	}
+
+	commit := &Commit{Id: logs.NewId(), Size: size, BuildId: buildId, Codec: codecSpec, State: CommitRunning, Started: time.Now(), Priority: priority, codec: c, caller: caller}
+	if working < commitWorkers() && len(queue) == 0 {
+		working++
+	} else {
+		if len(queue) >= config.CommitQueue {
+			return nil, ErrQueueFull
+		}
+		commit.State = CommitQueued
+
+		// behind every commit of the same or a higher priority
+		i := 0
+		for i < len(queue) && queue[i].Priority >= priority {
+			i++
+		}
+		queue = append(queue, nil)
+		copy(queue[i+1:], queue[i:])
+		queue[i] = commit
+	}
+
+	commits[commit.Id] = commit
+	commitWg.Add(1)
+
+	return commit, nil
+}
+
+// wait blocks while the commit is queued. A queued commit cut off by Drain
+// fails with ErrAborted.
+func (self *Commit) wait() error {
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	for self.State == CommitQueued {
+		select {
+		case <-aborted:
+			for i := range queue {
+				if queue[i] == self {
+					queue = append(queue[:i], queue[i+1:]...)
+					break
+				}
+			}
+			return ErrAborted
+		default:
+		}
+
+		workerFree.Wait()
+	}
+
+	return nil
+}
+
+// commitWorkers is how many commits may run at once. The caller must hold
+// commitMutex.
+func commitWorkers() int {
+	if config.CommitWorkers < 1 {
+		return 1
+	}
+	return config.CommitWorkers
+}
+
+// active reports whether the commit is queued or running. The caller must
+// hold commitMutex.
+func (self *Commit) active() bool {
+	return self.State == CommitQueued || self.State == CommitRunning
+}
+
+// finish records the outcome of a commit.
+func (self *Commit) finish(err error) {
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	// hand its worker to the next queued commit
+	if self.State == CommitRunning {
+		working--
+	}
+	for working < commitWorkers() && len(queue) > 0 {
+		queue[0].State = CommitRunning
+		queue = queue[1:]
+		working++
+	}
+	workerFree.Broadcast()
+
+	self.Finished = time.Now()
+	self.State = CommitDone
+	if err != nil {
+		self.State = CommitFailed
+		self.Error = err.Error()
+	}
+
+	metrics.Observe("commit", self.Started, err)
+	commitWg.Done()
+}
+
+// status returns a copy of the commit. The caller must hold commitMutex.
+func (self *Commit) status() Commit {
+	position := 0
+	for i := range queue {
+		if queue[i] == self {
+			position = i + 1
+		}
+	}
+
+	return Commit{
+		Id:         self.Id,
+		Compressed: atomic.LoadInt64(&self.Compressed),
+		Uploaded:   atomic.LoadInt64(&self.Uploaded),
+		Size:       self.Size,
+		BuildId:    self.BuildId,
+		Codec:      self.Codec,
+		State:      self.State,
+		Error:      self.Error,
+		Started:    self.Started,
+		Finished:   self.Finished,
+		Priority:   self.Priority,
+		Position:   position,
+
+		Deduplicated: self.Deduplicated,
+		Delta:        self.Delta,
+	}
+}
+
+// countReader tallies the bytes read through it. Commits read everything
+// through one, so it also cuts them off once Drain aborts them.
+type countReader struct {
+	io.Reader
+	count *int64
+}
+
+func (self countReader) Read(p []byte) (int, error) {
+	select {
+	case <-aborted:
+		return 0, ErrAborted
+	default:
+	}
+
+	n, err := self.Reader.Read(p)
+	atomic.AddInt64(self.count, int64(n))
+	return n, err
+}
+
+// countReaderAt is a countReader for uploads read in parts. A retried part is
+// counted again.
+type countReaderAt struct {
+	io.ReaderAt
+	count *int64
+}
+
+func (self countReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	select {
+	case <-aborted:
+		return 0, ErrAborted
+	default:
+	}
+
+	n, err := self.ReaderAt.ReadAt(p, off)
+	atomic.AddInt64(self.count, int64(n))
+	return n, err
+}
@@ -0,0 +1,212 @@
+package slurp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nanobox-io/slurp/backend"
+	"github.com/nanobox-io/slurp/config"
+)
+
+// delta is what a build is committed as when it's stored relative to the
+// build its stage was seeded from.
+type delta struct {
+	parent   *backend.Ref    // ref of the build the delta applies to
+	manifest *Manifest       // of the whole build, not just the delta
+	only     map[string]bool // entries the delta archives
+	deleted  []string        // entries removed from the parent first
+}
+
+// planDelta decides whether a build is committed as a delta of oldId, nil if
+// it's stored in full: deltas are disabled, oldId's manifest is missing or
+// out of date (eg. it was stored by an older slurp), or the chain would grow
+// longer than config.DeltaDepth.
+func planDelta(buildId, oldId, requestId string) (*delta, error) {
+	if config.DeltaDepth <= 0 || oldId == "" {
+		return nil, nil
+	}
+
+	old, err := GetManifest(oldId, requestId)
+	if err != nil || old.Blob == "" {
+		config.Log.Debug("Storing '%v' in full, '%v' has no manifest - %v", buildId, oldId, err)
+		return nil, nil
+	}
+
+	parent, err := backend.ReadRef(requestId, oldId)
+	if err != nil {
+		config.Log.Debug("Storing '%v' in full, '%v' can't be read - %v", buildId, oldId, err)
+		return nil, nil
+	}
+	if parent == nil {
+		// a plain tarball, also stored under its digest
+		parent = &backend.Ref{Blob: old.Blob}
+	}
+	if old.Blob != parent.Blob {
+		config.Log.Debug("Storing '%v' in full, '%v' has no matching manifest", buildId, oldId)
+		return nil, nil
+	}
+	if refDepth(parent)+1 > config.DeltaDepth {
+		config.Log.Debug("Storing '%v' in full, the delta chain is %d long", buildId, refDepth(parent))
+		return nil, nil
+	}
+
+	manifest, err := scanManifest(config.BuildDir + "/" + buildId)
+	if err != nil {
+		return nil, err
+	}
+	manifest.BuildId = buildId
+
+	d := &delta{parent: parent, manifest: manifest, only: map[string]bool{}}
+
+	prev := map[string]ManifestEntry{}
+	for _, entry := range old.Files {
+		prev[entry.Path] = entry
+	}
+
+	for _, entry := range manifest.Files {
+		was, ok := prev[entry.Path]
+		delete(prev, entry.Path)
+
+		if ok && sameEntry(was, entry) {
+			continue
+		}
+		d.only[entry.Path] = true
+
+		// a file can't be extracted over a directory or the other way around
+		if ok && was.Mode[0] != entry.Mode[0] {
+			d.deleted = append(d.deleted, entry.Path)
+		}
+	}
+
+	for _, entry := range old.Files {
+		if _, ok := prev[entry.Path]; ok {
+			d.deleted = append(d.deleted, entry.Path)
+		}
+	}
+
+	return d, nil
+}
+
+// sameEntry reports whether an entry is unchanged, times included
+func sameEntry(a, b ManifestEntry) bool {
+	return a.Sha256 == b.Sha256 && a.Size == b.Size && a.Mode == b.Mode && a.Link == b.Link && a.Mtime.Equal(b.Mtime)
+}
+
+// refDepth is how many deltas a ref is away from a full build
+func refDepth(ref *backend.Ref) int {
+	depth := 0
+	for ; ref.Parent != nil; ref = ref.Parent {
+		depth++
+	}
+	return depth
+}
+
+// scanManifest lists the files under dir like compress does, without
+// archiving them.
+func scanManifest(dir string) (*Manifest, error) {
+	manifest := &Manifest{Files: []ManifestEntry{}}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." || info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		entry := newManifestEntry(filepath.ToSlash(rel), info, link)
+		if info.Mode().IsRegular() {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			hash := sha256.New()
+			_, err = io.Copy(hash, file)
+			if err != nil {
+				return err
+			}
+			entry.Sha256 = hex.EncodeToString(hash.Sum(nil))
+		}
+		manifest.Files = append(manifest.Files, entry)
+
+		return nil
+	})
+
+	return manifest, err
+}
+
+// fetchBuild extracts a stored build into dir, applying its delta chain.
+func fetchBuild(buildId, dir, requestId string) error {
+	ref, err := backend.ReadRef(requestId, buildId)
+	if err != nil {
+		return err
+	}
+
+	// a plain tarball
+	if ref == nil {
+		blob, err := backend.ReadBlob(requestId, buildId)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+
+		return extract(blob, dir, CodecGzip)
+	}
+
+	return applyRef(ref, dir, requestId)
+}
+
+// applyRef extracts the build ref points at into dir, its parents first.
+func applyRef(ref *backend.Ref, dir, requestId string) error {
+	if ref.Parent != nil {
+		err := applyRef(ref.Parent, dir, requestId)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range ref.Deleted {
+		path, err := extractPath(dir, name)
+		if err != nil {
+			return err
+		}
+		os.RemoveAll(path)
+	}
+
+	blob, err := backend.ReadBlob(requestId, ref.Blob)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	return extract(blob, dir, ref.Codec)
+}
+
+// deletedIn reports whether a delta removes name, or a directory holding it.
+func deletedIn(ref *backend.Ref, name string) bool {
+	for _, deleted := range ref.Deleted {
+		if name == deleted || strings.HasPrefix(name, deleted+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package slurp
+
+import (
+	"errors"
+)
+
+// operations that have a build to themselves
+const (
+	opCreate = "create" // staging, and seeding from an old build
+	opCommit = "commit" // compressing, uploading and removing the stage
+	opDelete = "delete" // removing the stage
+)
+
+var (
+	// operations running on a build, keyed by build id. Syncs (rsync and sftp
+	// sessions, archive uploads) are counted on the stage instead, as any
+	// number of them can run at once. Guarded by mutex.
+	busy = map[string]string{}
+
+	// returned when a build is being staged or deleted
+	ErrBusy = errors.New("Build Is Busy")
+
+	// returned when a commit or delete is asked for while a stage is synced to
+	ErrSyncing = errors.New("Stage Is Being Synced To")
+)
+
+// lock gives a build to op until unlock is called. Nothing else may run on the
+// build meanwhile, nor may op start while the build's stage is synced to.
+func lock(buildId, op string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if running, ok := busy[buildId]; ok {
+		return busyError(running)
+	}
+	if stage, ok := stages[buildId]; ok && stage.syncs > 0 {
+		return ErrSyncing
+	}
+
+	busy[buildId] = op
+	return nil
+}
+
+// unlock frees a build locked by lock
+func unlock(buildId string) {
+	mutex.Lock()
+	delete(busy, buildId)
+	mutex.Unlock()
+}
+
+// busyError is the error for the build being busy with op
+func busyError(op string) error {
+	if op == opCommit {
+		return ErrCommitRunning
+	}
+	return ErrBusy
+}
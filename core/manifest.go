@@ -0,0 +1,132 @@
+package slurp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nanobox-io/slurp/backend"
+	"github.com/nanobox-io/slurp/buildid"
+)
+
+// suffix of the id a build's manifest is stored under
+const manifestSuffix = ".manifest"
+
+// Manifest lists the files of a stored build.
+type Manifest struct {
+	BuildId string          `json:"build-id"` // build described
+	Blob    string          `json:"blob"`     // digest the build is stored under
+	Files   []ManifestEntry `json:"files"`    // in archive order
+}
+
+// ManifestEntry describes a file, directory or symlink of a build.
+type ManifestEntry struct {
+	Path   string    `json:"path"`             // relative to the build root
+	Size   int64     `json:"size"`             // bytes, 0 for all but regular files
+	Mode   string    `json:"mode"`             // type and permissions (eg. "-rw-r--r--")
+	Mtime  time.Time `json:"mtime"`            // modification time, to the second
+	Sha256 string    `json:"sha256,omitempty"` // hex digest of a regular file's content
+	Link   string    `json:"link,omitempty"`   // target of a symlink
+}
+
+// ManifestDiff is what changed between two builds. Added and changed files are
+// as they are in the newer build, removed ones as they were in the older.
+type ManifestDiff struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Added   []ManifestEntry `json:"added"`
+	Removed []ManifestEntry `json:"removed"`
+	Changed []ManifestEntry `json:"changed"`
+}
+
+// newManifestEntry describes the file at rel, its digest added once hashed.
+func newManifestEntry(rel string, info os.FileInfo, link string) ManifestEntry {
+	entry := ManifestEntry{
+		Path:  rel,
+		Mode:  info.Mode().String(),
+		Mtime: info.ModTime().UTC().Round(time.Second), // as tar archives it
+		Link:  link,
+	}
+	if info.Mode().IsRegular() {
+		entry.Size = info.Size()
+	}
+	return entry
+}
+
+// writeManifest stores a build's manifest next to its blob.
+func writeManifest(manifest *Manifest, requestId string) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return backend.WriteBlob(requestId, manifest.BuildId+manifestSuffix, bytes.NewReader(b))
+}
+
+// GetManifest reads the manifest stored when a build was committed, logging
+// the backend request under requestId.
+func GetManifest(buildId, requestId string) (*Manifest, error) {
+	err := buildid.Validate(buildId)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := backend.ReadBlob(requestId, buildId+manifestSuffix)
+	if err == backend.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read manifest - %v", err)
+	}
+	defer blob.Close()
+
+	manifest := &Manifest{}
+	err = json.NewDecoder(blob).Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse manifest - %v", err)
+	}
+
+	return manifest, nil
+}
+
+// DiffBuilds compares the manifests of two stored builds. A file has changed
+// if its content, mode or link target has; a new mtime alone isn't a change.
+func DiffBuilds(fromId, toId, requestId string) (*ManifestDiff, error) {
+	from, err := GetManifest(fromId, requestId)
+	if err != nil {
+		return nil, err
+	}
+	to, err := GetManifest(toId, requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &ManifestDiff{From: fromId, To: toId, Added: []ManifestEntry{}, Removed: []ManifestEntry{}, Changed: []ManifestEntry{}}
+
+	old := map[string]ManifestEntry{}
+	for _, entry := range from.Files {
+		old[entry.Path] = entry
+	}
+
+	for _, entry := range to.Files {
+		prev, ok := old[entry.Path]
+		delete(old, entry.Path)
+
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, entry)
+		case prev.Sha256 != entry.Sha256 || prev.Mode != entry.Mode || prev.Link != entry.Link:
+			diff.Changed = append(diff.Changed, entry)
+		}
+	}
+
+	// keep the older build's order
+	for _, entry := range from.Files {
+		if _, ok := old[entry.Path]; ok {
+			diff.Removed = append(diff.Removed, entry)
+		}
+	}
+
+	return diff, nil
+}
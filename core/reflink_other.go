@@ -0,0 +1,12 @@
+//go:build !linux
+
+package slurp
+
+import (
+	"errors"
+)
+
+// reflink is only supported on linux.
+func reflink(src, dst string) error {
+	return errors.New("reflink not supported")
+}
@@ -0,0 +1,112 @@
+package slurp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nanobox-io/slurp/config"
+)
+
+var (
+	// closed once Drain is called, new stages and commits are refused
+	draining  = make(chan struct{})
+	drainOnce = sync.Once{}
+
+	// closed when Drain gives up waiting, cutting off running commits
+	aborted   = make(chan struct{})
+	abortOnce = sync.Once{}
+
+	// running commits
+	commitWg = sync.WaitGroup{}
+
+	// returned for new stages and commits once Drain is called
+	ErrShuttingDown = errors.New("Slurp Is Shutting Down")
+
+	// why a commit cut off by Drain failed
+	ErrAborted = errors.New("Commit Aborted By Shutdown")
+)
+
+// Drain refuses new stages and commits and waits until deadline for running
+// commits to finish. Commits still running then are aborted before they can
+// write a ref, leaving their stage failed so it can be committed again after a
+// restart. It returns how many commits were aborted.
+func Drain(deadline time.Time) int {
+	commitMutex.Lock()
+	drainOnce.Do(func() { close(draining) })
+	running := runningCommits()
+	commitMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		commitWg.Wait()
+		close(done)
+	}()
+
+	if running > 0 {
+		config.Log.Info("Waiting for %d commit(s) to finish...", running)
+	}
+
+	select {
+	case <-done:
+		return 0
+	case <-time.After(time.Until(deadline)):
+	}
+
+	commitMutex.Lock()
+	running = runningCommits()
+	commitMutex.Unlock()
+
+	abortOnce.Do(func() { close(aborted) })
+
+	// wake queued commits so they fail too
+	commitMutex.Lock()
+	workerFree.Broadcast()
+	commitMutex.Unlock()
+
+	// aborted commits fail fast unless stuck on the backend
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		config.Log.Error("Commits didn't stop after being aborted")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for id, stage := range stages {
+		if stage.State == StateCommitting {
+			config.Log.Info("Abandoning commit of '%v'", id)
+			stage.State = StateFailed
+		}
+	}
+
+	err := saveStages()
+	if err != nil {
+		config.Log.Error("Failed to save stage registry - %v", err)
+	}
+
+	return running
+}
+
+// isDraining reports whether Drain has been called.
+func isDraining() bool {
+	select {
+	case <-draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// runningCommits counts the commits queued or in progress. The caller must
+// hold commitMutex.
+func runningCommits() int {
+	running := 0
+	for _, commit := range commits {
+		if commit.active() {
+			running++
+		}
+	}
+	return running
+}
@@ -2,95 +2,320 @@
 package slurp
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"sync"
+	"time"
 
 	"github.com/nanobox-io/slurp/backend"
+	"github.com/nanobox-io/slurp/buildid"
 	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/dirsize"
+	"github.com/nanobox-io/slurp/logs"
+	"github.com/nanobox-io/slurp/metrics"
 	"github.com/nanobox-io/slurp/ssh"
 )
 
 var (
-	// copy of all non-committed builds
-	builds []string
-
-	// mutex ensures updates to builds are atomic
+	// mutex ensures updates to stages are atomic
 	mutex = sync.Mutex{}
 )
 
-// todo: slurp restart persistance? regenerate builds from config.BuildDir contents
-
 // AddStage fetches the build "oldId" from the backend, uncompresses it to "newId",
-// generates, and returns, a new user secret for rsyncing.
+// generates, and returns, a new user secret (and keypair if withKey) for
+// rsyncing. A stage left idle longer than ttl (config.StageTTL if 0) is removed.
+// Recently committed or fetched builds are seeded from the local cache instead.
+// A build that is already staged is refused with ErrExists.
+// A build stored as a delta is rebuilt from its whole chain. The new stage is
+// audited as caller's.
 // Bash equivalent:
 //  `curl localhost:7410/blobs/oldId | tar -C buildDir/newId -zxf -`
-func AddStage(oldId, newId string) error {
-	// prepare location for extraction
-	err := os.MkdirAll(config.BuildDir+"/"+newId, 0755)
+// though the archive is extracted natively.
+func AddStage(oldId, newId string, ttl time.Duration, withKey bool, caller logs.Caller) (ssh.Login, error) {
+	start := time.Now()
+	login, err := addStage(oldId, newId, ttl, withKey, caller)
+	metrics.Observe("add", start, err)
+	return login, err
+}
+
+func addStage(oldId, newId string, ttl time.Duration, withKey bool, caller logs.Caller) (ssh.Login, error) {
+	err := buildid.Validate(newId)
+	if err == nil && oldId != "" {
+		err = buildid.Validate(oldId)
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to create build dir - %v", err)
+		return ssh.Login{}, err
 	}
 
-	// backend.ReadBlob(oldId) | tar -C buildDir/newId -zxf -
-	if oldId != "" {
-		// stream last build from backend
-		res, err := backend.ReadBlob(oldId)
+	if isDraining() {
+		return ssh.Login{}, ErrShuttingDown
+	}
+
+	err = lock(newId, opCreate)
+	if err != nil {
+		return ssh.Login{}, err
+	}
+	defer unlock(newId)
+
+	// a stage isn't replaced, it has to be deleted first
+	mutex.Lock()
+	_, exists := stages[newId]
+	mutex.Unlock()
+	if exists {
+		return ssh.Login{}, ErrExists
+	}
+
+	// refuse new stages before the disk behind them fills up
+	if config.MinFree > 0 {
+		free, err := freeSpace(config.BuildDir)
 		if err != nil {
-			return fmt.Errorf("Failed to get old build - %v", err)
+			return ssh.Login{}, fmt.Errorf("Failed to check free space - %v", err)
 		}
+		if free >= 0 && free < config.MinFree {
+			config.Log.Error("Refusing stage '%v', %d bytes free in the build dir", newId, free)
+			return ssh.Login{}, ErrNoSpace
+		}
+	}
 
-		config.Log.Trace("Fetched build")
-
-		// prepare to extract to new build dir
-		cmd := exec.Command("tar", "--atime-preserve", "-C", newId, "-zxf", "-")
-		// cmd.Dir = "/tmp"
-		cmd.Dir = config.BuildDir
+	// prepare location for extraction
+	err = os.MkdirAll(config.BuildDir+"/"+newId, 0755)
+	if err != nil {
+		return ssh.Login{}, fmt.Errorf("Failed to create build dir - %v", err)
+	}
 
-		// pipe build to extract command
-		cmd.Stdin = res
+	// a stage that fails to be added is removed, so it isn't adopted as a
+	// stage after a restart nor extracted over by a retry
+	added := false
+	defer func() {
+		if !added {
+			ssh.DelUser(newId)
+			os.RemoveAll(config.BuildDir + "/" + newId)
+		}
+	}()
 
-		config.Log.Trace("Running extract command '%v'", cmd.Args)
-		// err := cmd.Run()
-		out, err := cmd.CombinedOutput()
+	// backend.ReadBlob(oldId) | extract(buildDir/newId), unless it is cached
+	cached := false
+	if oldId != "" {
+		cached = cacheFetch(oldId, config.BuildDir+"/"+newId)
+	}
+	if oldId != "" && !cached {
+		// stream last build, and any it is a delta of, from backend
+		err = fetchBuild(oldId, config.BuildDir+"/"+newId, caller.RequestId)
 		if err != nil {
-			return fmt.Errorf("Failed to extract build to dir '%s' - %v", out, err)
+			return ssh.Login{}, fmt.Errorf("Failed to get old build - %v", err)
 		}
 
 		config.Log.Trace("Extracted build")
-		res.Close()
+
+		// cache it before it is synced to
+		cacheStore(oldId, config.BuildDir+"/"+newId)
+	}
+
+	login, cred, err := ssh.NewCredential(newId, withKey)
+	if err != nil {
+		return ssh.Login{}, err
 	}
 
-	err = ssh.AddUser(newId)
+	err = ssh.AddUser(newId, cred)
 	if err != nil {
-		return fmt.Errorf("Failed to add user - %v", err)
+		return ssh.Login{}, fmt.Errorf("Failed to add user - %v", err)
+	}
+
+	stage := &Stage{NewId: newId, OldId: oldId, Created: time.Now(), State: StateStaged, Cached: cached, Credential: &cred}
+	if ttl > 0 {
+		stage.TTL = ttl.String()
 	}
 
 	mutex.Lock()
-	builds = append(builds, newId)
+	stages[newId] = stage
+	err = saveStages()
+	if err != nil {
+		delete(stages, newId)
+	}
 	mutex.Unlock()
+	if err != nil {
+		return ssh.Login{}, fmt.Errorf("Failed to save stage registry - %v", err)
+	}
+	added = true
+	audit(caller, logs.ActionCreate, newId, oldId)
+
+	return login, nil
+}
+
+// ExtractStage unpacks a tar or tar.gz archive read from r into a stage, over
+// whatever it holds already. Like an rsync session, it keeps the stage from
+// being reaped while it runs. A malformed archive fails with an ArchiveError.
+func ExtractStage(buildId string, r io.Reader, caller logs.Caller) error {
+	start := time.Now()
+	err := extractStage(buildId, r, caller)
+	metrics.Observe("extract", start, err)
+	return err
+}
+
+func extractStage(buildId string, r io.Reader, caller logs.Caller) error {
+	err := buildid.Validate(buildId)
+	if err != nil {
+		return err
+	}
+
+	if isDraining() {
+		return ErrShuttingDown
+	}
+
+	err = syncHook(buildId, true)
+	if err != nil {
+		return err
+	}
+	defer syncHook(buildId, false)
+
+	// what the stage already holds counts against its quota
+	var limit int64
+	if config.StageQuota > 0 {
+		limit = config.StageQuota - dirsize.Of(config.BuildDir+"/"+buildId)
+		if limit <= 0 {
+			return ErrQuota
+		}
+	}
+
+	err = extractAny(r, config.BuildDir+"/"+buildId, limit)
+	if _, ok := err.(ArchiveError); ok || err == ErrQuota {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to extract archive - %v", err)
+	}
+
+	config.Log.Trace("Extracted archive into '%v'", buildId)
+	audit(caller, logs.ActionUpload, buildId, "")
 
 	return nil
 }
 
 // CommitStage compresses the new build, uploads it to the backend and removes
-// the user secret from the ssh server.
+// the user secret from the ssh server. The compressed build is stored under
+// its sha256 digest, so a build identical to a stored one is only written as
+// a ref to it. A new full gzipped build is also stored as a tarball under the
+// build id, anything else gets a ref there. With config.DeltaDepth set, only
+// what changed since the stage's old build is uploaded.
+// The build is compressed with codecSpec (see ParseCodec), or config.Codec if
+// it's empty. With config.CommitWorkers commits running, it waits in a queue
+// ordered by priority, highest first.
 // Bash equivalent:
 //  `tar -C buildDir/buildId -czf - . | curl localhost:7410/blobs/newId -T -`
-func CommitStage(buildId string) error {
-	// remove user first
-	err := getUser(buildId)
+// though the archive is compressed natively. It is refused while the stage is
+// synced to. The finished commit is returned.
+func CommitStage(buildId, codecSpec string, priority int, caller logs.Caller) (Commit, error) {
+	return commitLocked(buildId, codecSpec, priority, caller, false)
+}
+
+// CommitAndDeleteStage commits the build like CommitStage, then removes its
+// stage before the build is unlocked, so nothing can get at the stage between
+// the two.
+func CommitAndDeleteStage(buildId, codecSpec string, priority int, caller logs.Caller) (Commit, error) {
+	return commitLocked(buildId, codecSpec, priority, caller, true)
+}
+
+// commitLocked runs a commit holding the build's lock throughout, removing the
+// stage once it is stored if remove is set.
+func commitLocked(buildId, codecSpec string, priority int, caller logs.Caller, remove bool) (Commit, error) {
+	err := buildid.Validate(buildId)
+	if err != nil {
+		return Commit{}, err
+	}
+
+	err = lock(buildId, opCommit)
+	if err != nil {
+		return Commit{}, err
+	}
+	defer unlock(buildId)
+
+	commit, err := startCommit(buildId, codecSpec, priority, caller)
+	if err != nil {
+		return Commit{}, err
+	}
+
+	err = commit.wait()
 	if err == nil {
-		err = ssh.DelUser(buildId)
+		err = commitStage(commit)
+	}
+	if err == nil && remove {
+		start := time.Now()
+		err = removeStage(buildId, caller, logs.ActionDelete)
+		metrics.Observe("delete", start, err)
+	}
+	commit.finish(err)
+
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	return commit.status(), err
+}
+
+// CommitStageAsync starts committing the build in the background, or queues
+// it, removing the stage once it is stored. Progress, and the commit's place
+// in the queue, can be followed with GetCommit by the returned commit's id.
+func CommitStageAsync(buildId, codecSpec string, priority int, caller logs.Caller) (Commit, error) {
+	err := buildid.Validate(buildId)
+	if err != nil {
+		return Commit{}, err
+	}
+
+	// check for existing build before handing out a commit
+	_, err = os.Stat(config.BuildDir + "/" + buildId)
+	if err != nil {
+		return Commit{}, fmt.Errorf("Build dir doesn't exist - %v", err)
+	}
+
+	err = lock(buildId, opCommit)
+	if err != nil {
+		return Commit{}, err
+	}
+
+	commit, err := startCommit(buildId, codecSpec, priority, caller)
+	if err != nil {
+		unlock(buildId)
+		return Commit{}, err
+	}
+	audit(caller, logs.ActionCommitStarted, buildId, "")
+
+	// the build stays locked until its stage is removed
+	go func() {
+		err := commit.wait()
+		if err == nil {
+			err = commitStage(commit)
+		}
+		if err == nil {
+			start := time.Now()
+			err = removeStage(buildId, caller, logs.ActionDelete)
+			metrics.Observe("delete", start, err)
+		}
 		if err != nil {
-			return fmt.Errorf("Failed to remove user - %v", err)
+			config.Log.Error("Failed to commit '%v' - %v", buildId, err)
 		}
-	}
+		unlock(buildId)
+		commit.finish(err)
+	}()
 
-	// don't buffer (free the rams)
-	blobReader, blobWriter := io.Pipe()
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	return commit.status(), nil
+}
+
+// commitStage does the work of CommitStage, tallying progress in commit.
+func commitStage(commit *Commit) error {
+	buildId := commit.BuildId
+	requestId := commit.caller.RequestId
+
+	// remove user first
+	err := ssh.DelUser(buildId)
+	if err != nil {
+		return fmt.Errorf("Failed to remove user - %v", err)
+	}
 
 	config.Log.Trace("Preparing to compress '%v'", config.BuildDir+"/"+buildId)
 
@@ -100,63 +325,152 @@ func CommitStage(buildId string) error {
 		return fmt.Errorf("Build dir doesn't exist - %v", err)
 	}
 
-	// tar -C buildDir/buildId -czf - . | backend.WriteBlob(buildId)
-	// prepare to compress build dir
-	cmd := exec.Command("tar", "-C", config.BuildDir+"/"+buildId, "-czf", "-", ".")
-	// cmd.Dir = "/tmp"
-	cmd.Dir = config.BuildDir
-
-	// keep the modified time unchanged when compressing (keep md5 the same)
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "GZIP=-n")
-
-	// pipe compressed build to write command
-	cmd.Stdout = blobWriter
+	setState(buildId, StateCommitting)
 
-	config.Log.Trace("Running compress command '%v'", cmd.Args)
+	// compress to disk (not the rams), hashing along the way, so the build's
+	// digest is known before deciding whether to upload it
+	spool, err := ioutil.TempFile(config.BuildDir, ".commit-")
+	if err != nil {
+		setState(buildId, StateFailed)
+		return fmt.Errorf("Failed to create spool file - %v", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
 
-	// prep writing build to backend
-	echan := make(chan error, 1)
+	// only what changed since the old build, if it can be stored as a delta
+	mutex.Lock()
+	var oldId string
+	if stage, ok := stages[buildId]; ok {
+		oldId = stage.OldId
+	}
+	mutex.Unlock()
 
-	// start stream to backend
-	go func() {
-		echan <- backend.WriteBlob(buildId, blobReader)
-	}()
+	d, err := planDelta(buildId, oldId, requestId)
+	if err != nil {
+		setState(buildId, StateFailed)
+		return fmt.Errorf("Failed to compare build - %v", err)
+	}
 
-	// compress the build
-	err = cmd.Run()
+	hash := sha256.New()
+	manifest := &Manifest{BuildId: buildId}
+	ref := backend.Ref{}
+	if d != nil {
+		commitMutex.Lock()
+		commit.Delta = true
+		commitMutex.Unlock()
+
+		err = compress(config.BuildDir+"/"+buildId, io.MultiWriter(spool, hash), commit.codec, &commit.Compressed, &Manifest{}, d.only)
+		manifest = d.manifest
+		ref = backend.Ref{Parent: d.parent, Deleted: d.deleted}
+	} else {
+		err = compress(config.BuildDir+"/"+buildId, io.MultiWriter(spool, hash), commit.codec, &commit.Compressed, manifest, nil)
+	}
 	if err != nil {
+		setState(buildId, StateFailed)
 		return fmt.Errorf("Failed to compress build - %v", err)
-		// the error `io: read/write on closed pipe` here is likely due to
-		// wrong backend protocol (http/https) resolve with different scheme
-		// for hoarder 'hoarder[s]://'
 	}
 
 	config.Log.Trace("Compressed build")
 
-	// if the command finished, blobWriter is done
-	blobWriter.Close()
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+
+	exists, err := backend.HasBlob(requestId, digest)
+	if err != nil {
+		setState(buildId, StateFailed)
+		return fmt.Errorf("Failed to check for existing build - %v", err)
+	}
+
+	if exists {
+		config.Log.Debug("Build '%v' matches stored '%v', skipping upload", buildId, digest)
+		commitMutex.Lock()
+		commit.Deduplicated = true
+		commitMutex.Unlock()
+	} else {
+		err = upload(requestId, digest, spool, &commit.Uploaded)
+		if err != nil {
+			setState(buildId, StateFailed)
+			return fmt.Errorf("Failed to write build - %v", err)
+		}
+	}
 
-	// wait for WriteBlob to finish
-	err = <-echan
+	// the manifest goes first, so a stored build always has one
+	manifest.Blob = digest
+	err = writeManifest(manifest, requestId)
 	if err != nil {
-		return fmt.Errorf("Failed to write build - %v", err)
+		setState(buildId, StateFailed)
+		return fmt.Errorf("Failed to write build manifest - %v", err)
+	}
+
+	// a new full gzipped build is also stored as a plain tarball under its id,
+	// like slurp always has, anything else needs a ref to be read back
+	if !exists && d == nil && commit.codec.name == CodecGzip {
+		err = upload(requestId, buildId, spool, &commit.Uploaded)
+		if err != nil {
+			setState(buildId, StateFailed)
+			return fmt.Errorf("Failed to write build - %v", err)
+		}
+	} else {
+		ref.Blob = digest
+		ref.Codec = commit.codec.name
+		err = backend.WriteRef(requestId, buildId, ref)
+		if err != nil {
+			setState(buildId, StateFailed)
+			return fmt.Errorf("Failed to write build ref - %v", err)
+		}
 	}
 
 	config.Log.Trace("Uploaded build")
 
+	cacheStore(buildId, config.BuildDir+"/"+buildId)
+
+	setState(buildId, StateCommitted)
+	audit(commit.caller, logs.ActionCommit, buildId, oldId)
+
 	return nil
 }
 
-// DeleteStage removes files for a specific build.
-func DeleteStage(buildId string) error {
+// upload writes the spooled build to the backend as id. Large builds are
+// uploaded in parts, retried on their own.
+func upload(requestId, id string, spool *os.File, count *int64) error {
+	info, err := spool.Stat()
+	if err != nil {
+		return err
+	}
+	return backend.WriteBlobAt(requestId, id, countReaderAt{spool, count}, info.Size())
+}
+
+// DeleteStage removes files for a specific build, audited as caller's. It is
+// refused while the stage is synced to.
+func DeleteStage(buildId string, caller logs.Caller) error {
+	start := time.Now()
+	err := deleteStage(buildId, caller)
+	metrics.Observe("delete", start, err)
+	return err
+}
+
+func deleteStage(buildId string, caller logs.Caller) error {
+	// never remove anything outside of a stage
+	err := buildid.Validate(buildId)
+	if err != nil {
+		return err
+	}
+
+	err = lock(buildId, opDelete)
+	if err != nil {
+		return err
+	}
+	defer unlock(buildId)
+
+	return removeStage(buildId, caller, logs.ActionDelete)
+}
+
+// removeStage does the work of DeleteStage, for a caller holding the build's
+// lock, auditing the removal as action.
+func removeStage(buildId string, caller logs.Caller, action string) error {
 	// remove user first
-	err := getUser(buildId)
+	err := ssh.DelUser(buildId)
 	if err != nil {
-		err = ssh.DelUser(buildId)
-		if err != nil {
-			return fmt.Errorf("Failed to remove user - %v", err)
-		}
+		return fmt.Errorf("Failed to remove user - %v", err)
 	}
 
 	config.Log.Trace("Removing '%v'", config.BuildDir+"/"+buildId)
@@ -167,25 +481,24 @@ func DeleteStage(buildId string) error {
 		return fmt.Errorf("Failed to remove build dir - %v", err)
 	}
 
-	// remove cached build
+	// forget the stage
 	mutex.Lock()
-	for i := range builds {
-		if builds[i] == buildId {
-			builds = append(builds[:i], builds[i+1:]...)
-			break
-		}
+	var oldId string
+	if stage, ok := stages[buildId]; ok {
+		oldId = stage.OldId
 	}
+	delete(stages, buildId)
+	err = saveStages()
 	mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("Failed to save stage registry - %v", err)
+	}
+	audit(caller, action, buildId, oldId)
 
 	return nil
 }
 
-// getUser gets the user secret corresponding to an uncommitted build.
-func getUser(buildId string) error {
-	for _, build := range builds {
-		if build == buildId {
-			return nil
-		}
-	}
-	return fmt.Errorf("No Build Found")
+// audit records a change to a build made for caller
+func audit(caller logs.Caller, action, buildId, oldId string) {
+	logs.Audit(logs.Record{Action: action, BuildId: buildId, OldId: oldId, Actor: caller.Actor, User: caller.User, RequestId: caller.RequestId})
 }
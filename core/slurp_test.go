@@ -1,57 +1,924 @@
 package slurp_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jcelliott/lumber"
 
 	"github.com/nanobox-io/slurp/backend"
+	"github.com/nanobox-io/slurp/buildid"
 	"github.com/nanobox-io/slurp/config"
 	"github.com/nanobox-io/slurp/core"
+	"github.com/nanobox-io/slurp/logs"
 )
 
 func TestMain(m *testing.M) {
-	// clean test dir
+	// clean test dirs
 	os.RemoveAll("/tmp/slurpCore")
+	os.RemoveAll("/tmp/slurpCoreCache")
 
 	// manually configure
 	initialize()
 
 	rtn := m.Run()
 
-	// clean test dir
+	// clean test dirs
 	os.RemoveAll("/tmp/slurpCore")
+	os.RemoveAll("/tmp/slurpCoreCache")
 
 	os.Exit(rtn)
 }
 
 func TestAddStage(t *testing.T) {
-	err := slurp.AddStage("", "core-new")
+	login, err := slurp.AddStage("", "core-new", 0, true, logs.Caller{})
 	if err != nil {
 		t.Error(err)
 	}
+	if login.User != "core-new" || login.Secret == "" || login.PrivateKey == "" {
+		t.Errorf("%+v doesn't match expected login", login)
+	}
+
+	// a stage isn't replaced
+	_, err = slurp.AddStage("newbuild", "core-new", 0, false, logs.Caller{})
+	if err != slurp.ErrExists {
+		t.Errorf("%v doesn't match expected error", err)
+	}
+}
+
+func TestAddStageFailed(t *testing.T) {
+	_, err := slurp.AddStage("core-missing", "core-failed", 0, false, logs.Caller{})
+	if err == nil {
+		t.Error("staged from a missing build")
+	}
 
-	// use build from api_test
-	err = slurp.AddStage("newbuild", "core-new")
+	// nothing is left to be adopted on restart
+	_, err = os.Stat(config.BuildDir + "/core-failed")
+	if !os.IsNotExist(err) {
+		t.Errorf("failed stage left behind - %v", err)
+	}
+	_, err = slurp.GetStage("core-failed")
+	if err != slurp.ErrNotFound {
+		t.Errorf("%v doesn't match expected error", err)
+	}
+}
+
+func TestCommitStage(t *testing.T) {
+	_, err := slurp.CommitStage("core-new", "", 0, logs.Caller{})
 	if err != nil {
 		t.Error(err)
 	}
 }
 
-func TestCommitStage(t *testing.T) {
-	err := slurp.CommitStage("core-new")
+func TestCommitAndDeleteStage(t *testing.T) {
+	_, err := slurp.AddStage("", "core-deleted", 0, false, logs.Caller{})
 	if err != nil {
 		t.Error(err)
+		t.FailNow()
+	}
+
+	commit, err := slurp.CommitAndDeleteStage("core-deleted", "", 0, logs.Caller{})
+	if err != nil || commit.State != slurp.CommitDone {
+		t.Errorf("%q doesn't match expected state - %v", commit.State, err)
+	}
+	_, err = slurp.GetStage("core-deleted")
+	if err != slurp.ErrNotFound {
+		t.Errorf("stage not removed after commit - %v", err)
+	}
+}
+
+func TestCommitDeterministic(t *testing.T) {
+	_, err := slurp.AddStage("", "core-a", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = ioutil.WriteFile(config.BuildDir+"/core-a/file", []byte("SomeThing"), 0644)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = slurp.CommitStage("core-a", "", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// an identical tree must produce an identical blob
+	_, err = slurp.AddStage("core-a", "core-b", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	commit, err := slurp.CommitStage("core-b", "", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	a, err := readBlob("core-a")
+	if err != nil {
+		t.Error(err)
+	}
+	b, err := readBlob("core-b")
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Errorf("blobs of identical builds differ")
+	}
+
+	// and is only stored once
+	if !commit.Deduplicated {
+		t.Errorf("identical build was uploaded again")
+	}
+
+	// the first is a plain tarball under its id, the second a ref to it
+	ref, err := backend.ReadRef("", "core-a")
+	if err != nil || ref != nil {
+		t.Errorf("'core-a' isn't stored as a plain tarball - %v", err)
+	}
+	ref, err = backend.ReadRef("", "core-b")
+	if err != nil || ref == nil {
+		t.Errorf("'core-b' isn't stored as a ref - %v", err)
+	}
+
+	slurp.DeleteStage("core-a", logs.Caller{})
+	slurp.DeleteStage("core-b", logs.Caller{})
+}
+
+func TestCommitDeterministicZstd(t *testing.T) {
+	_, err := slurp.AddStage("", "core-za", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// several of the encoder's blocks
+	big := make([]byte, 8<<20)
+	rand.Read(big)
+	err = ioutil.WriteFile(config.BuildDir+"/core-za/big", big, 0644)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = slurp.CommitStage("core-za", "zstd", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// an identical tree compresses to an identical blob
+	_, err = slurp.AddStage("core-za", "core-zb", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	commit, err := slurp.CommitStage("core-zb", "zstd", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if !commit.Deduplicated {
+		t.Errorf("identical zstd build compressed differently")
+	}
+
+	slurp.DeleteStage("core-za", logs.Caller{})
+	slurp.DeleteStage("core-zb", logs.Caller{})
+}
+
+func TestManifest(t *testing.T) {
+	_, err := slurp.AddStage("", "core-m1", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ioutil.WriteFile(config.BuildDir+"/core-m1/changed", []byte("old"), 0644)
+	ioutil.WriteFile(config.BuildDir+"/core-m1/removed", []byte("gone"), 0644)
+	_, err = slurp.CommitStage("core-m1", "", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	manifest, err := slurp.GetManifest("core-m1", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(manifest.Files) != 2 || manifest.Files[0].Path != "changed" || manifest.Files[0].Size != 3 ||
+		manifest.Files[0].Sha256 != fmt.Sprintf("%x", sha256.Sum256([]byte("old"))) {
+		t.Errorf("%+v doesn't match expected manifest", manifest.Files)
+	}
+
+	_, err = slurp.AddStage("core-m1", "core-m2", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ioutil.WriteFile(config.BuildDir+"/core-m2/changed", []byte("new"), 0644)
+	os.Remove(config.BuildDir + "/core-m2/removed")
+	ioutil.WriteFile(config.BuildDir+"/core-m2/added", []byte("added"), 0644)
+	_, err = slurp.CommitStage("core-m2", "", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	diff, err := slurp.DiffBuilds("core-m1", "core-m2", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(diff.Added) != 1 || diff.Added[0].Path != "added" ||
+		len(diff.Removed) != 1 || diff.Removed[0].Path != "removed" ||
+		len(diff.Changed) != 1 || diff.Changed[0].Path != "changed" {
+		t.Errorf("%+v doesn't match expected diff", diff)
+	}
+
+	_, err = slurp.GetManifest("core-missing", "")
+	if err != slurp.ErrNotFound {
+		t.Errorf("%v doesn't match expected not found", err)
+	}
+
+	slurp.DeleteStage("core-m1", logs.Caller{})
+	slurp.DeleteStage("core-m2", logs.Caller{})
+}
+
+func TestCommitStageAsync(t *testing.T) {
+	_, err := slurp.AddStage("", "core-async", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	commit, err := slurp.CommitStageAsync("core-async", "", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// poll until the commit finishes
+	for i := 0; i < 50 && commit.State == slurp.CommitRunning; i++ {
+		<-time.After(100 * time.Millisecond)
+		commit, err = slurp.GetCommit(commit.Id)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	if commit.State != slurp.CommitDone {
+		t.Errorf("%q doesn't match expected state - %v", commit.State, commit.Error)
+	}
+
+	_, err = slurp.GetStage("core-async")
+	if err != slurp.ErrNotFound {
+		t.Errorf("stage not removed after commit - %v", err)
+	}
+}
+
+func TestCommitQueue(t *testing.T) {
+	config.CommitWorkers, config.CommitQueue = 1, 2
+	defer func() { config.CommitWorkers, config.CommitQueue = 2, 32 }()
+
+	ids := []string{"core-q1", "core-q2", "core-q3", "core-q4"}
+	for _, id := range ids {
+		_, err := slurp.AddStage("", id, 0, false, logs.Caller{})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+
+	// keep the only worker busy while the others queue
+	big := make([]byte, 16<<20)
+	rand.Read(big)
+	err := ioutil.WriteFile(config.BuildDir+"/core-q1/big", big, 0644)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	started := map[string]string{}
+	for i, priority := range []int{0, 0, 5} {
+		commit, err := slurp.CommitStageAsync(ids[i], "", priority, logs.Caller{})
+		if err != nil {
+			t.Error(err)
+		}
+		started[ids[i]] = commit.Id
+	}
+
+	// the higher priority commit jumps the queue
+	for id, position := range map[string]int{"core-q2": 2, "core-q3": 1} {
+		commit, _ := slurp.GetCommit(started[id])
+		if commit.State != slurp.CommitQueued || commit.Position != position {
+			t.Errorf("'%v' is %v at %d, expected queued at %d", id, commit.State, commit.Position, position)
+		}
+	}
+
+	_, err = slurp.CommitStageAsync("core-q4", "", 0, logs.Caller{})
+	if err != slurp.ErrQueueFull {
+		t.Errorf("%v doesn't match expected queue full", err)
+	}
+	slurp.DeleteStage("core-q4", logs.Caller{})
+
+	// all of them get their turn
+	for _, id := range ids[:3] {
+		var commit slurp.Commit
+		for i := 0; i < 100; i++ {
+			commit, _ = slurp.GetCommit(started[id])
+			if commit.State != slurp.CommitQueued && commit.State != slurp.CommitRunning {
+				break
+			}
+			<-time.After(100 * time.Millisecond)
+		}
+		if commit.State != slurp.CommitDone {
+			t.Errorf("'%v' is %v, expected done - %v", id, commit.State, commit.Error)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	_, err := slurp.AddStage("", "core-cached", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = ioutil.WriteFile(config.BuildDir+"/core-cached/file", []byte("SomeThing"), 0640)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = slurp.CommitStage("core-cached", "", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// the committed build is seeded from the cache
+	hits, _ := slurp.CacheStats()
+	_, err = slurp.AddStage("core-cached", "core-seeded", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if now, _ := slurp.CacheStats(); now != hits+1 {
+		t.Errorf("%d cache hits, expected %d", now, hits+1)
+	}
+
+	stage, err := slurp.GetStage("core-seeded")
+	if err != nil {
+		t.Error(err)
+	}
+	if !stage.Cached {
+		t.Error("stage not marked as cached")
+	}
+
+	info, err := os.Stat(config.BuildDir + "/core-seeded/file")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("%v doesn't match expected mode", info.Mode().Perm())
+	}
+
+	slurp.DeleteStage("core-seeded", logs.Caller{})
+}
+
+func TestCacheIsolated(t *testing.T) {
+	_, err := slurp.AddStage("", "core-iso", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ioutil.WriteFile(config.BuildDir+"/core-iso/file", []byte("old"), 0644)
+	_, err = slurp.CommitStage("core-iso", "", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// changes made in place to a seeded stage stay in it
+	_, err = slurp.AddStage("core-iso", "core-iso-b", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	file, err := os.OpenFile(config.BuildDir+"/core-iso-b/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	file.WriteAt([]byte("new"), 0)
+	file.Close()
+	os.Chmod(config.BuildDir+"/core-iso-b/file", 0600)
+
+	_, err = slurp.AddStage("core-iso", "core-iso-c", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	content, _ := ioutil.ReadFile(config.BuildDir + "/core-iso-c/file")
+	if string(content) != "old" {
+		t.Errorf("%q doesn't match expected content", content)
+	}
+	info, err := os.Stat(config.BuildDir + "/core-iso-c/file")
+	if err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("mode of cached file changed - %v", err)
+	}
+
+	slurp.DeleteStage("core-iso", logs.Caller{})
+	slurp.DeleteStage("core-iso-b", logs.Caller{})
+	slurp.DeleteStage("core-iso-c", logs.Caller{})
+}
+
+func TestDelta(t *testing.T) {
+	// builds must come from the backend, not the cache
+	config.DeltaDepth, config.CacheSize = 2, 0
+	defer func() { config.DeltaDepth, config.CacheSize = 0, int64(5<<30) }()
+
+	files := map[string]string{"kept": "kept", "changed": "old", "removed": "removed", "dir/file": "file"}
+	_, err := slurp.AddStage("", "core-d0", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(config.BuildDir+"/core-d0/"+name), 0755)
+		ioutil.WriteFile(config.BuildDir+"/core-d0/"+name, []byte(content), 0644)
+	}
+	_, err = slurp.CommitStage("core-d0", "", 0, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// each build changes a file, removes one and adds one
+	changes := []func(dir string){
+		func(dir string) {
+			ioutil.WriteFile(dir+"/changed", []byte("new"), 0644)
+			os.Remove(dir + "/removed")
+			ioutil.WriteFile(dir+"/added", []byte("added"), 0644)
+			delete(files, "removed")
+			files["changed"], files["added"] = "new", "added"
+		},
+		func(dir string) {
+			// a directory replaced by a file
+			os.RemoveAll(dir + "/dir")
+			ioutil.WriteFile(dir+"/dir", []byte("now a file"), 0644)
+			delete(files, "dir/file")
+			files["dir"] = "now a file"
+		},
+		func(dir string) {
+			ioutil.WriteFile(dir+"/third", []byte("third"), 0644)
+			files["third"] = "third"
+		},
+	}
+	for i, change := range changes {
+		old, id := fmt.Sprintf("core-d%d", i), fmt.Sprintf("core-d%d", i+1)
+		_, err = slurp.AddStage(old, id, 0, false, logs.Caller{})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		change(config.BuildDir + "/" + id)
+		commit, err := slurp.CommitStage(id, "", 0, logs.Caller{})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		// deltas up to the depth, then a full build
+		ref, err := backend.ReadRef("", id)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if delta := i < 2; commit.Delta != delta || (ref != nil && ref.Parent != nil) != delta {
+			t.Errorf("'%v' stored as a delta: %v, expected %v", id, commit.Delta, delta)
+		}
+	}
+
+	// every build rebuilds to its full tree
+	_, err = slurp.AddStage("core-d3", "core-check", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	got := map[string]string{}
+	filepath.Walk(config.BuildDir+"/core-check", func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			content, _ := ioutil.ReadFile(path)
+			rel, _ := filepath.Rel(config.BuildDir+"/core-check", path)
+			got[rel] = string(content)
+		}
+		return nil
+	})
+	if fmt.Sprint(got) != fmt.Sprint(files) {
+		t.Errorf("%v doesn't match expected files %v", got, files)
+	}
+
+	// files are found along the chain
+	file, _, err := slurp.ReadBuildFile("core-d2", "kept", "")
+	if err != nil {
+		t.Error(err)
+	} else {
+		content, _ := ioutil.ReadAll(file)
+		file.Close()
+		if string(content) != "kept" {
+			t.Errorf("%q doesn't match expected content", content)
+		}
+	}
+	_, _, err = slurp.ReadBuildFile("core-d2", "dir/file", "")
+	if err != slurp.ErrFileNotFound {
+		t.Errorf("%v doesn't match expected not found", err)
+	}
+
+	// and a delta downloads as a full build
+	build, _, err := slurp.ReadBuild("core-d2", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	zr, err := gzip.NewReader(build)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	var names []string
+	tr := tar.NewReader(zr)
+	for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+		names = append(names, hdr.Name)
+	}
+	build.Close()
+	if strings.Join(names, " ") != "./ ./added ./changed ./dir ./kept" {
+		t.Errorf("%q doesn't match expected entries", names)
+	}
+
+	for i := 0; i < 4; i++ {
+		slurp.DeleteStage(fmt.Sprintf("core-d%d", i), logs.Caller{})
+	}
+	slurp.DeleteStage("core-check", logs.Caller{})
+}
+
+func TestCodec(t *testing.T) {
+	// builds must come from the backend, not the cache
+	config.DeltaDepth, config.CacheSize = 2, 0
+	defer func() { config.DeltaDepth, config.CacheSize = 0, int64(5<<30) }()
+
+	_, err := slurp.CommitStage("core-z0", "brotli", 0, logs.Caller{})
+	if err == nil {
+		t.Error("Unknown codec accepted")
+	}
+	_, err = slurp.CommitStage("core-z0", "gzip:10", 0, logs.Caller{})
+	if err == nil {
+		t.Error("Bad gzip level accepted")
+	}
+
+	// a zstd build, then a delta of it stored uncompressed
+	codecs := []string{"zstd:3", "none"}
+	for i, codec := range codecs {
+		old, id := "", fmt.Sprintf("core-z%d", i)
+		if i > 0 {
+			old = fmt.Sprintf("core-z%d", i-1)
+		}
+		_, err = slurp.AddStage(old, id, 0, false, logs.Caller{})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		ioutil.WriteFile(fmt.Sprintf("%v/%v/file%d", config.BuildDir, id, i), []byte(codec), 0644)
+		commit, err := slurp.CommitStage(id, codec, 0, logs.Caller{})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		if commit.Codec != codec {
+			t.Errorf("%q doesn't match expected codec %q", commit.Codec, codec)
+		}
+	}
+
+	ref, err := backend.ReadRef("", "core-z1")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if ref.Codec != slurp.CodecNone || ref.Parent == nil || ref.Parent.Codec != slurp.CodecZstd {
+		t.Errorf("%+v doesn't record the expected codecs", ref)
+	}
+
+	// the chain is read with each build's own codec
+	_, err = slurp.AddStage("core-z1", "core-zcheck", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for i, codec := range codecs {
+		content, _ := ioutil.ReadFile(fmt.Sprintf("%v/core-zcheck/file%d", config.BuildDir, i))
+		if string(content) != codec {
+			t.Errorf("%q doesn't match expected content %q", content, codec)
+		}
+
+		file, _, err := slurp.ReadBuildFile("core-z1", fmt.Sprintf("file%d", i), "")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		content, _ = ioutil.ReadAll(file)
+		file.Close()
+		if string(content) != codec {
+			t.Errorf("%q doesn't match expected content %q", content, codec)
+		}
+	}
+
+	build, codec, err := slurp.ReadBuild("core-z0", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	build.Close()
+	if codec != slurp.CodecZstd {
+		t.Errorf("%q doesn't match expected codec", codec)
+	}
+
+	for _, id := range []string{"core-z0", "core-z1", "core-zcheck"} {
+		slurp.DeleteStage(id, logs.Caller{})
 	}
 }
 
 func TestDeleteStage(t *testing.T) {
-	err := slurp.DeleteStage("core-new")
+	err := slurp.DeleteStage("core-new", logs.Caller{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// nothing outside of a stage is removed
+	for _, id := range []string{"", "..", ".stages.json"} {
+		err = slurp.DeleteStage(id, logs.Caller{})
+		if _, ok := err.(buildid.Error); !ok {
+			t.Errorf("%v doesn't match expected invalid id", err)
+		}
+	}
+	_, err = os.Stat(config.BuildDir)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	// the build dir never has this much free
+	config.MinFree = 1 << 62
+	_, err := slurp.AddStage("", "core-quota", 0, false, logs.Caller{})
+	config.MinFree = 0
+	if err != slurp.ErrNoSpace {
+		t.Errorf("%v doesn't match expected no space", err)
+	}
+
+	_, err = slurp.AddStage("", "core-quota", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer slurp.DeleteStage("core-quota", logs.Caller{})
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"a", "b"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+		tw.Write([]byte("hello"))
+	}
+	tw.Close()
+
+	// the second file takes it past the quota
+	config.StageQuota = 8
+	defer func() { config.StageQuota = 0 }()
+	err = slurp.ExtractStage("core-quota", bytes.NewReader(buf.Bytes()), logs.Caller{})
+	if err != slurp.ErrQuota {
+		t.Errorf("%v doesn't match expected quota exceeded", err)
+	}
+	_, err = os.Stat(config.BuildDir + "/core-quota/b")
+	if !os.IsNotExist(err) {
+		t.Errorf("file past the quota was extracted - %v", err)
+	}
+
+	// now the stage itself is over it
+	config.StageQuota = 5
+	err = slurp.ExtractStage("core-quota", bytes.NewReader(buf.Bytes()), logs.Caller{})
+	if err != slurp.ErrQuota {
+		t.Errorf("%v doesn't match expected quota exceeded", err)
+	}
+}
+
+func TestExtractSymlink(t *testing.T) {
+	_, err := slurp.AddStage("", "core-symlink", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer slurp.DeleteStage("core-symlink", logs.Caller{})
+
+	outside := "/tmp/slurpOutside"
+	os.MkdirAll(outside, 0755)
+	defer os.RemoveAll(outside)
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(outside, mtime, mtime)
+
+	// a directory replaced by a symlink, and a symlink by a directory
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Mode: 0700, ModTime: old, Typeflag: tar.TypeDir})
+	tw.WriteHeader(&tar.Header{Name: "dir", Linkname: outside, Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "link", Linkname: outside, Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "link/", Mode: 0700, ModTime: old, Typeflag: tar.TypeDir})
+	tw.Close()
+
+	err = slurp.ExtractStage("core-symlink", bytes.NewReader(buf.Bytes()), logs.Caller{})
 	if err != nil {
 		t.Error(err)
 	}
+
+	info, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 || !info.ModTime().Equal(mtime) {
+		t.Errorf("directory outside the stage changed to %v, %v", info.Mode(), info.ModTime())
+	}
+	info, err = os.Lstat(config.BuildDir + "/core-symlink/link")
+	if err != nil || !info.IsDir() {
+		t.Errorf("symlink not replaced by a directory - %v", err)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	_, err := slurp.AddStage("", "core-locked", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// an upload stays open until its body ends
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() { done <- slurp.ExtractStage("core-locked", pr, logs.Caller{}) }()
+	for i := 0; i < 50; i++ {
+		stage, _ := slurp.GetStage("core-locked")
+		if stage.State == slurp.StateSyncing {
+			break
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	_, err = slurp.CommitStage("core-locked", "", 0, logs.Caller{})
+	if err != slurp.ErrSyncing {
+		t.Errorf("%v doesn't match expected syncing", err)
+	}
+	err = slurp.DeleteStage("core-locked", logs.Caller{})
+	if err != slurp.ErrSyncing {
+		t.Errorf("%v doesn't match expected syncing", err)
+	}
+	_, err = slurp.AddStage("", "core-locked", 0, false, logs.Caller{})
+	if err != slurp.ErrSyncing {
+		t.Errorf("%v doesn't match expected syncing", err)
+	}
+
+	tw := tar.NewWriter(pw)
+	tw.Close()
+	pw.Close()
+	err = <-done
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = slurp.DeleteStage("core-locked", logs.Caller{})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	_, err := slurp.AddStage("", "core-kept", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// a stage dir slurp has no record of
+	err = os.MkdirAll(config.BuildDir+"/core-adopted", 0755)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	err = slurp.Initialize()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	stage, err := slurp.GetStage("core-kept")
+	if err != nil {
+		t.Error(err)
+	}
+	if stage.State != slurp.StateStaged {
+		t.Errorf("%q doesn't match expected state", stage.State)
+	}
+
+	_, err = slurp.GetStage("core-adopted")
+	if err != nil {
+		t.Error(err)
+	}
+
+	slurp.DeleteStage("core-kept", logs.Caller{})
+	slurp.DeleteStage("core-adopted", logs.Caller{})
+}
+
+func TestReapStages(t *testing.T) {
+	_, err := slurp.AddStage("", "core-reaped", time.Millisecond, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = slurp.AddStage("", "core-kept", time.Hour, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	_, err = slurp.AddStage("", "core-synced", time.Millisecond, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// an upload keeps its stage busy, however old
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() { done <- slurp.ExtractStage("core-synced", pr, logs.Caller{}) }()
+
+	<-time.After(10 * time.Millisecond)
+	slurp.ReapStages()
+
+	_, err = slurp.GetStage("core-synced")
+	if err != nil {
+		t.Errorf("stage being synced to reaped - %v", err)
+	}
+	tar.NewWriter(pw).Close()
+	pw.Close()
+	<-done
+	slurp.DeleteStage("core-synced", logs.Caller{})
+
+	_, err = slurp.GetStage("core-reaped")
+	if err != slurp.ErrNotFound {
+		t.Errorf("idle stage not reaped - %v", err)
+	}
+	_, err = os.Stat(config.BuildDir + "/core-reaped")
+	if !os.IsNotExist(err) {
+		t.Errorf("idle stage dir not removed - %v", err)
+	}
+
+	_, err = slurp.GetStage("core-kept")
+	if err != nil {
+		t.Error(err)
+	}
+
+	slurp.DeleteStage("core-kept", logs.Caller{})
+}
+
+// must run last, a drained slurp stays drained
+func TestDrain(t *testing.T) {
+	_, err := slurp.AddStage("", "core-drained", 0, false, logs.Caller{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	aborted := slurp.Drain(time.Now().Add(time.Second))
+	if aborted != 0 {
+		t.Errorf("%d commits aborted, none were running", aborted)
+	}
+
+	_, err = slurp.AddStage("", "core-refused", 0, false, logs.Caller{})
+	if err != slurp.ErrShuttingDown {
+		t.Errorf("stage added while draining - %v", err)
+	}
+	_, err = slurp.CommitStage("core-drained", "", 0, logs.Caller{})
+	if err != slurp.ErrShuttingDown {
+		t.Errorf("commit started while draining - %v", err)
+	}
+
+	slurp.DeleteStage("core-drained", logs.Caller{})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -61,6 +928,7 @@ func TestDeleteStage(t *testing.T) {
 // manually configure and start internals
 func initialize() {
 	config.BuildDir = "/tmp/slurpCore/"
+	config.CacheDir = "/tmp/slurpCoreCache/"
 	config.LogLevel = "fatal"
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
 
@@ -71,3 +939,14 @@ func initialize() {
 		os.Exit(0)
 	}
 }
+
+// read a whole blob from the backend
+func readBlob(id string) ([]byte, error) {
+	blob, err := backend.ReadBlob("", id)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	return ioutil.ReadAll(blob)
+}
@@ -0,0 +1,15 @@
+package slurp
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// freeSpace is the bytes available to slurp on the filesystem holding dir.
+func freeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package slurp
+
+// freeSpace is only known on linux, elsewhere it is -1 and never too little.
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,382 @@
+package slurp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nanobox-io/slurp/buildid"
+	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/dirsize"
+	"github.com/nanobox-io/slurp/logs"
+	"github.com/nanobox-io/slurp/metrics"
+	"github.com/nanobox-io/slurp/ssh"
+)
+
+// stage states
+const (
+	StateStaged     = "staged"     // ready to be synced to or committed
+	StateSyncing    = "syncing"    // an rsync session is open
+	StateCommitting = "committing" // being compressed and uploaded
+	StateCommitted  = "committed"  // stored in the backend, awaiting removal
+	StateFailed     = "failed"     // last commit failed, may be retried
+)
+
+// Stage is the persisted record of a non-committed build.
+type Stage struct {
+	NewId    string    `json:"new-id"`    // build being staged
+	OldId    string    `json:"old-id"`    // build the stage was seeded from
+	Created  time.Time `json:"created"`   // when the stage was added
+	LastSync time.Time `json:"last-sync"` // when the last rsync session ended
+	Size     int64     `json:"size"`      // bytes of files, filled in when read
+	State    string    `json:"state"`     // one of the State* constants
+	TTL      string    `json:"ttl"`       // idle time before removal, overrides config.StageTTL
+	Cached   bool      `json:"cached"`    // seeded from the local cache rather than the backend
+
+	// ssh credential, kept only in the registry
+	Credential *ssh.Credential `json:"credential,omitempty"`
+
+	syncs int // open rsync sessions
+}
+
+var (
+	// all non-committed builds, keyed by build id
+	stages = map[string]*Stage{}
+
+	// starts the reaper on the first Initialize
+	reaperOnce = sync.Once{}
+
+	// returned when a build has no stage
+	ErrNotFound = errors.New("No Build Found")
+
+	// returned when adding a stage for a build that already has one
+	ErrExists = errors.New("Build Already Staged")
+
+	// returned when the build dir has less than config.MinFree bytes free
+	ErrNoSpace = errors.New("Not Enough Free Space For A New Stage")
+
+	// returned when an upload would grow a stage past config.StageQuota
+	ErrQuota = errors.New("Stage Quota Exceeded")
+)
+
+// stagesFile is where the stage registry is persisted. It lives in the build
+// dir so it can't drift from the stages it describes.
+func stagesFile() string {
+	return filepath.Join(config.BuildDir, ".stages.json")
+}
+
+// Initialize checks config.Codec, loads the stage registry and reconciles it
+// with the contents of config.BuildDir, re-authorizing any stage that survived
+// a restart.
+func Initialize() error {
+	_, err := parseCodec(config.Codec)
+	if err != nil {
+		return fmt.Errorf("Bad codec - %v", err)
+	}
+
+	err = os.MkdirAll(config.BuildDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create build dir - %v", err)
+	}
+
+	saved := map[string]*Stage{}
+	b, err := ioutil.ReadFile(stagesFile())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read stage registry - %v", err)
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &saved)
+		if err != nil {
+			return fmt.Errorf("Failed to parse stage registry - %v", err)
+		}
+	}
+
+	dirs, err := ioutil.ReadDir(config.BuildDir)
+	if err != nil {
+		return fmt.Errorf("Failed to list build dir - %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stages = map[string]*Stage{}
+	for _, dir := range dirs {
+		// builds being rebuilt for download when slurp stopped
+		if dir.IsDir() && strings.HasPrefix(dir.Name(), ".build-") {
+			os.RemoveAll(filepath.Join(config.BuildDir, dir.Name()))
+			continue
+		}
+
+		if !dir.IsDir() {
+			// spool files of commits cut off by the restart
+			if strings.HasPrefix(dir.Name(), ".commit-") {
+				os.Remove(filepath.Join(config.BuildDir, dir.Name()))
+			}
+			continue
+		}
+
+		// eg. lost+found, it can't be staged to
+		if buildid.Validate(dir.Name()) != nil {
+			config.Log.Info("Ignoring '%v', it isn't a valid build id", dir.Name())
+			continue
+		}
+
+		stage, ok := saved[dir.Name()]
+		if !ok {
+			// a stage dir we have no record of, adopt it
+			config.Log.Info("Adopting unregistered stage '%v'", dir.Name())
+			stage = &Stage{NewId: dir.Name(), Created: dir.ModTime(), State: StateStaged}
+		}
+
+		// sessions didn't survive the restart, and a commit cut off by it
+		// never made it to the backend
+		switch stage.State {
+		case StateSyncing:
+			stage.State = StateStaged
+		case StateCommitting:
+			stage.State = StateFailed
+		}
+
+		stages[stage.NewId] = stage
+	}
+
+	for id := range saved {
+		if _, ok := stages[id]; !ok {
+			config.Log.Info("Dropping stage '%v', build dir is gone", id)
+		}
+	}
+
+	// re-authorize surviving stages
+	for id, stage := range stages {
+		if stage.Credential == nil {
+			config.Log.Info("Stage '%v' has no credential, it can only be committed or deleted", id)
+			continue
+		}
+		err = ssh.AddUser(id, *stage.Credential)
+		if err != nil {
+			return fmt.Errorf("Failed to add user - %v", err)
+		}
+	}
+
+	ssh.SyncHook = syncHook
+
+	config.Log.Debug("Restored %d stage(s)", len(stages))
+
+	err = saveStages()
+	if err != nil {
+		return err
+	}
+
+	err = initCache()
+	if err != nil {
+		return err
+	}
+
+	reaperOnce.Do(func() { go reaper() })
+
+	return nil
+}
+
+// GetStage returns a copy of the record for a non-committed build.
+func GetStage(buildId string) (Stage, error) {
+	mutex.Lock()
+	stage, ok := stages[buildId]
+	if !ok {
+		mutex.Unlock()
+		return Stage{}, ErrNotFound
+	}
+	found := *stage
+	found.Credential = nil
+	mutex.Unlock()
+
+	found.Size = dirsize.Of(config.BuildDir + "/" + buildId)
+
+	return found, nil
+}
+
+// ListStages returns a copy of every non-committed build's record, oldest first.
+func ListStages() []Stage {
+	mutex.Lock()
+	list := make([]Stage, 0, len(stages))
+	for _, stage := range stages {
+		found := *stage
+		found.Credential = nil
+		list = append(list, found)
+	}
+	mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+
+	for i := range list {
+		list[i].Size = dirsize.Of(config.BuildDir + "/" + list[i].NewId)
+	}
+
+	return list
+}
+
+// syncHook tracks rsync sessions so a stage reports when it is being synced to.
+// A session is refused while the build is being staged, committed or deleted.
+func syncHook(buildId string, active bool) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stage, ok := stages[buildId]
+	if !ok {
+		if active {
+			return ErrNotFound
+		}
+		return nil
+	}
+
+	if active {
+		if op, ok := busy[buildId]; ok {
+			return busyError(op)
+		}
+		stage.syncs++
+		if stage.State == StateStaged || stage.State == StateFailed {
+			stage.State = StateSyncing
+		}
+	} else {
+		stage.syncs--
+		stage.LastSync = time.Now()
+		if stage.syncs <= 0 && stage.State == StateSyncing {
+			stage.syncs = 0
+			stage.State = StateStaged
+		}
+	}
+
+	err := saveStages()
+	if err != nil {
+		config.Log.Error("Failed to save stage registry - %v", err)
+	}
+
+	return nil
+}
+
+// ReapStages removes every stage left idle (no rsync session since it was
+// created or last synced to) longer than its ttl.
+func ReapStages() {
+	var ids []string
+
+	mutex.Lock()
+	for id, stage := range stages {
+		if idle(stage) {
+			ids = append(ids, id)
+		}
+	}
+	mutex.Unlock()
+
+	for _, id := range ids {
+		err := reapStage(id)
+		if err != nil {
+			config.Log.Error("Failed to reap stage '%v' - %v", id, err)
+		}
+	}
+}
+
+// reapStage removes a stage picked by ReapStages, if it is still idle once
+// nothing else can start on it.
+func reapStage(buildId string) error {
+	err := lock(buildId, opDelete)
+	if err != nil {
+		// busy, so not idle after all
+		config.Log.Debug("Not reaping stage '%v' - %v", buildId, err)
+		return nil
+	}
+	defer unlock(buildId)
+
+	mutex.Lock()
+	stage, ok := stages[buildId]
+	reap := ok && idle(stage)
+	var found Stage
+	if reap {
+		found = *stage
+	}
+	mutex.Unlock()
+	if !reap {
+		return nil
+	}
+
+	config.Log.Info("Reaping stage '%v', idle since %v", buildId, lastActive(&found).Format(time.RFC3339))
+	start := time.Now()
+	err = removeStage(buildId, logs.Caller{Actor: "reaper", RequestId: logs.NewId()}, logs.ActionExpire)
+	metrics.Observe("delete", start, err)
+	return err
+}
+
+// idle reports whether a stage has gone unsynced longer than its ttl. The
+// caller must hold mutex.
+func idle(stage *Stage) bool {
+	ttl := config.StageTTL
+	if stage.TTL != "" {
+		ttl, _ = time.ParseDuration(stage.TTL)
+	}
+
+	// busy stages aren't idle
+	if ttl <= 0 || stage.syncs > 0 || stage.State == StateCommitting {
+		return false
+	}
+
+	return time.Since(lastActive(stage)) > ttl
+}
+
+// reaper runs ReapStages every minute. Initialize starts it once, however
+// often it is called.
+func reaper() {
+	for range time.Tick(time.Minute) {
+		ReapStages()
+	}
+}
+
+// lastActive is when a stage was last synced to, or created if never.
+func lastActive(stage *Stage) time.Time {
+	if stage.LastSync.IsZero() {
+		return stage.Created
+	}
+	return stage.LastSync
+}
+
+// setState updates and persists the state of a registered stage.
+func setState(buildId, state string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stage, ok := stages[buildId]
+	if !ok {
+		return
+	}
+	stage.State = state
+
+	err := saveStages()
+	if err != nil {
+		config.Log.Error("Failed to save stage registry - %v", err)
+	}
+}
+
+// saveStages writes the stage registry to disk. The caller must hold mutex.
+func saveStages() error {
+	metrics.Stages.Set(float64(len(stages)))
+
+	b, err := json.Marshal(stages)
+	if err != nil {
+		return err
+	}
+
+	// write then rename so a crash never leaves a partial registry
+	tmp := stagesFile() + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, stagesFile())
+}
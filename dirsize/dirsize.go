@@ -0,0 +1,22 @@
+// Package "dirsize" measures directories the way slurp counts stages against
+// their quota: the bytes of the regular files in them, symlinks and
+// directories themselves counting for nothing.
+package dirsize
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Of sums the size of the regular files under dir. Files that can't be read
+// are skipped, a missing dir is empty.
+func Of(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,26 @@
+package dirsize_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nanobox-io/slurp/dirsize"
+)
+
+func TestOf(t *testing.T) {
+	dir := "/tmp/slurpDirsize"
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(dir+"/sub", 0755)
+	ioutil.WriteFile(dir+"/a", []byte("hello"), 0644)
+	ioutil.WriteFile(dir+"/sub/b", []byte("world!"), 0644)
+	os.Symlink("a", dir+"/link")
+
+	if size := dirsize.Of(dir); size != 11 {
+		t.Errorf("%d doesn't match expected size 11", size)
+	}
+	if size := dirsize.Of(dir + "/missing"); size != 0 {
+		t.Errorf("%d doesn't match expected size 0", size)
+	}
+}
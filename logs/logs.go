@@ -0,0 +1,166 @@
+// Package "logs" records what slurp was asked to do: an access log of api
+// calls, ssh logins, rsync and sftp sessions and backend requests, and an
+// append-only audit log of the builds that were created, committed and
+// deleted.
+package logs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nanobox-io/slurp/config"
+)
+
+// Entry is a request slurp served
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`       // api, ssh-auth, rsync, sftp or backend
+	RequestId string    `json:"request-id"` // ties the entries of one api call or ssh connection together
+	BuildId   string    `json:"build-id"`   // build the request was for, if known
+	Remote    string    `json:"remote"`     // address of the client, or the backend
+	Op        string    `json:"op"`         // what was requested
+	Duration  float64   `json:"duration"`   // seconds the request took
+	Outcome   string    `json:"outcome"`    // ok, or how it failed
+	Status    int       `json:"status"`     // http status or rsync exit code
+	Error     string    `json:"error,omitempty"`
+}
+
+// Record is a change to the builds slurp holds
+type Record struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"` // one of the Action* constants
+	BuildId   string    `json:"build-id"`
+	OldId     string    `json:"old-id,omitempty"`     // build a stage was seeded from
+	Actor     string    `json:"actor"`                // address of the client, or "reaper"
+	User      string    `json:"user,omitempty"`       // who the client authenticated as
+	RequestId string    `json:"request-id,omitempty"` // call or session that made the change
+}
+
+// Caller is who asked for a change to a build, or for a stored build, so
+// the records and backend requests it causes can be tied back to it
+type Caller struct {
+	Actor     string // address of the api client, or "reaper"
+	User      string // who the client authenticated as, see Record
+	RequestId string // api call asking
+}
+
+// audited actions
+const (
+	ActionCreate        = "create"         // a stage was added
+	ActionUpload        = "upload"         // an archive was extracted into a stage
+	ActionCommit        = "commit"         // a build was stored
+	ActionCommitStarted = "commit-started" // an async commit was started
+	ActionDelete        = "delete"         // a stage was removed
+	ActionExpire        = "expire"         // an idle stage was reaped
+	ActionPush          = "push"           // an rsync or sftp session wrote to a stage
+)
+
+var (
+	// json access entries go here, nil for text through config.Log
+	access io.Writer
+
+	// audit records go here, nil if there is no audit log
+	audit io.WriteCloser
+
+	// mutex keeps entries and records whole
+	mutex = sync.Mutex{}
+)
+
+// Open starts writing access entries as json to stdout if config.LogFormat
+// is "json", and audit records to config.AuditLog if it is set.
+func Open() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	switch config.LogFormat {
+	case "json":
+		access = os.Stdout
+	case "text":
+		access = nil
+	default:
+		return fmt.Errorf("Unknown log format '%v'", config.LogFormat)
+	}
+
+	if audit != nil {
+		audit.Close()
+		audit = nil
+	}
+	if config.AuditLog != "" {
+		err := os.MkdirAll(filepath.Dir(config.AuditLog), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create audit log dir - %v", err)
+		}
+
+		f, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("Failed to open audit log - %v", err)
+		}
+		audit = f
+	}
+
+	return nil
+}
+
+// NewId generates a random id, for requests and commits
+func NewId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Access logs a request. Json entries are always written, text ones at debug
+// level.
+func Access(entry Entry) {
+	entry.Time = time.Now().UTC()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if access == nil {
+		config.Log.Debug("%s %s %s '%s' %s %s %d %.3fs %s", entry.Kind, entry.RequestId, entry.Remote, entry.BuildId, entry.Op, entry.Outcome, entry.Status, entry.Duration, entry.Error)
+		return
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		config.Log.Error("Failed to log access - %v", err)
+		return
+	}
+	access.Write(append(b, '\n'))
+}
+
+// Audit appends a record to the audit log, if there is one
+func Audit(record Record) {
+	record.Time = time.Now().UTC()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if audit == nil {
+		return
+	}
+
+	b, err := json.Marshal(record)
+	if err == nil {
+		// one write per record, so concurrent appends don't interleave
+		_, err = audit.Write(append(b, '\n'))
+	}
+	if err != nil {
+		config.Log.Error("Failed to write audit record - %v", err)
+	}
+}
+
+// Outcome describes how a request ended
+func Outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
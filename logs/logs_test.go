@@ -0,0 +1,66 @@
+package logs_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/logs"
+)
+
+func TestOpen(t *testing.T) {
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("fatal"))
+	config.AuditLog = ""
+
+	config.LogFormat = "xml"
+	if logs.Open() == nil {
+		t.Error("Unknown log format accepted")
+	}
+
+	config.LogFormat = "text"
+	err := logs.Open()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	os.RemoveAll("/tmp/slurpLogs")
+	defer os.RemoveAll("/tmp/slurpLogs")
+
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("fatal"))
+	config.LogFormat = "text"
+	config.AuditLog = "/tmp/slurpLogs/audit.log"
+	err := logs.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs.Audit(logs.Record{Action: logs.ActionCommit, BuildId: "build1", Actor: "127.0.0.1"})
+	logs.Audit(logs.Record{Action: logs.ActionExpire, BuildId: "build2", Actor: "reaper"})
+
+	b, err := ioutil.ReadFile(config.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []logs.Record
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var r logs.Record
+		err = dec.Decode(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+
+	if len(records) != 2 || records[0].Action != logs.ActionCommit || records[1].BuildId != "build2" || records[1].Time.IsZero() {
+		t.Errorf("%+v doesn't match expected records", records)
+	}
+}
@@ -14,13 +14,28 @@
 //  Flags:
 //    -a, --api-address="https://127.0.0.1:1566": Listen uri for the API (scheme defaults to https)
 //    -t, --api-token="secret": Token for API Access
+//        --audit-log="/var/db/slurp/audit.log": Append-only log of the builds created, committed and deleted (empty to disable)
 //    -b, --build-dir="/var/db/slurp/build/": Build staging directory
+//        --cache-dir="/var/db/slurp/cache/": Directory to cache recent builds in
+//        --cache-size=5368709120: Bytes of builds to cache (0 to disable)
+//        --codec="gzip": Compression codec for builds [gzip|zstd|none], with an optional level (gzip:1-9, zstd:1-22)
+//        --commit-queue=32: Commits that may wait for a worker before more are refused
+//        --commit-workers=2: Commits compressed and uploaded at once
 //    -c, --config-file="": Configuration file to load
+//        --delta-depth=0: Longest chain of delta builds before a full one is stored (0 to always store full builds)
+//        --embedded-rsync[=false]: Receive pushes in process rather than with the system rsync
 //    -i, --insecure[=true]: Disable tls certificate verification when connecting to storage
+//        --log-format="text": Format of request logs [text|json]
 //    -l, --log-level="info": Log level to output [fatal|error|info|debug|trace]
+//        --min-free=0: Bytes that must be free in the build dir to add a stage (0 to disable)
+//        --part-size=67108864: Bytes per part of multi-part uploads (0 to upload in one stream)
+//        --part-uploads=4: Parts of a multi-part upload in flight at once
+//        --shutdown-timeout=1m0s: How long to wait for rsync sessions and commits on shutdown
 //    -s, --ssh-addr="127.0.0.1:1567": Address ssh server will listen on (ip:port combo)
 //    -k, --ssh-host="/var/db/slurp/slurp_rsa": SSH host (private) key file
-//    -S, --store-addr="hoarders://127.0.0.1:7410": Storage host address
+//        --stage-quota=0: Bytes a stage may hold, enforced while it is synced to (0 for no limit)
+//        --stage-ttl=24h0m0s: Idle time before a stage is removed (0 to keep forever)
+//    -S, --store-addr="hoarders://127.0.0.1:7410": Storage address [hoarder[s]://|file://|s3[+http]://]
 //    -T, --store-token="": Storage auth token
 //    -v, --version[=false]: Print version info and exit
 //
@@ -28,6 +43,10 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/jcelliott/lumber"
 	"github.com/spf13/cobra"
@@ -35,6 +54,8 @@ import (
 	"github.com/nanobox-io/slurp/api"
 	"github.com/nanobox-io/slurp/backend"
 	"github.com/nanobox-io/slurp/config"
+	core "github.com/nanobox-io/slurp/core"
+	"github.com/nanobox-io/slurp/logs"
 	"github.com/nanobox-io/slurp/ssh"
 )
 
@@ -83,13 +104,26 @@ func preFlight(ccmd *cobra.Command, args []string) error {
 func startSlurp(ccmd *cobra.Command, args []string) error {
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
 
+	err := logs.Open()
+	if err != nil {
+		config.Log.Fatal("Log init failed - %v", err)
+		return fmt.Errorf("")
+	}
+
 	// initialize backend
-	err := backend.Initialize()
+	err = backend.Initialize()
 	if err != nil {
 		config.Log.Fatal("Backend init failed - %v", err)
 		return fmt.Errorf("")
 	}
 
+	// restore stages from a previous run
+	err = core.Initialize()
+	if err != nil {
+		config.Log.Fatal("Stage restore failed - %v", err)
+		return fmt.Errorf("")
+	}
+
 	// start ssh server
 	err = ssh.Start()
 	if err != nil {
@@ -98,15 +132,50 @@ func startSlurp(ccmd *cobra.Command, args []string) error {
 	}
 
 	// start api
-	err = api.StartApi()
-	if err != nil {
+	apiErr := make(chan error, 1)
+	go func() {
+		apiErr <- api.StartApi()
+	}()
+
+	// wait for the api to fail or a signal to stop
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err = <-apiErr:
 		config.Log.Fatal("Api start failed - %v", err)
 		return fmt.Errorf("")
+	case sig := <-sigs:
+		config.Log.Info("Received %v, shutting down...", sig)
 	}
 
+	shutdown()
+
 	return nil
 }
 
+// shutdown stops taking new work and waits, up to config.ShutdownTimeout, for
+// rsync sessions and commits to finish. Whatever is still running by then is
+// killed, leaving its stage to be synced or committed again after a restart.
+func shutdown() {
+	deadline := time.Now().Add(config.ShutdownTimeout)
+
+	api.Drain()
+	ssh.Stop()
+
+	killed := ssh.Drain(deadline)
+	if killed > 0 {
+		config.Log.Info("Killed %d rsync session(s)", killed)
+	}
+
+	aborted := core.Drain(deadline)
+	if aborted > 0 {
+		config.Log.Info("Aborted %d commit(s)", aborted)
+	}
+
+	config.Log.Info("Shutdown complete")
+}
+
 func main() {
 	slurp.Execute()
 }
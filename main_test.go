@@ -18,13 +18,15 @@ import (
 )
 
 func TestMain(m *testing.M) {
-	// clean test dir
+	// clean test dirs
 	os.RemoveAll("/tmp/slurpMain")
+	os.RemoveAll("/tmp/slurpMainCache")
+	os.Remove("/tmp/slurpMainAudit.log")
 
 	// manually configure
 	initialize()
 
-	args := strings.Split("-b /tmp/slurpMain/ -l fatal -k /tmp/slurp_rsa -s 127.0.0.1:1568 -a https://127.0.0.1:1564", " ")
+	args := strings.Split("-b /tmp/slurpMain/ --cache-dir /tmp/slurpMainCache/ --audit-log /tmp/slurpMainAudit.log -l fatal -k /tmp/slurp_rsa -s 127.0.0.1:1568 -a https://127.0.0.1:1564", " ")
 	slurp.SetArgs(args)
 
 	// start api
@@ -32,8 +34,10 @@ func TestMain(m *testing.M) {
 	<-time.After(time.Second)
 	rtn := m.Run()
 
-	// clean test dir
+	// clean test dirs
 	os.RemoveAll("/tmp/slurpMain")
+	os.RemoveAll("/tmp/slurpMainCache")
+	os.Remove("/tmp/slurpMainAudit.log")
 
 	os.Exit(rtn)
 }
@@ -0,0 +1,102 @@
+// Package "metrics" holds the prometheus metrics slurp exposes at /metrics.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// stage operations (add, extract, commit, delete) by result (ok, error)
+	Operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "slurp",
+		Name:      "operations_total",
+		Help:      "Stage operations by operation and result.",
+	}, []string{"op", "result"})
+
+	// how long stage operations take, backend requests included
+	OperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "slurp",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of stage operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+	}, []string{"op"})
+
+	// how long backend requests take, to tell slurp's time from the backend's
+	BackendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "slurp",
+		Name:      "backend_request_duration_seconds",
+		Help:      "Duration of backend requests (until the first byte for reads).",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 16),
+	}, []string{"op"})
+
+	BackendRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "slurp",
+		Name:      "backend_read_bytes_total",
+		Help:      "Bytes read from the backend.",
+	})
+
+	BackendWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "slurp",
+		Name:      "backend_written_bytes_total",
+		Help:      "Bytes written to the backend.",
+	})
+
+	// backend errors by request (read, write, part, assemble, has) and type
+	// (timeout, connection, status, other)
+	BackendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "slurp",
+		Name:      "backend_errors_total",
+		Help:      "Backend errors by request and type.",
+	}, []string{"op", "type"})
+
+	Stages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "slurp",
+		Name:      "stages",
+		Help:      "Builds currently staged.",
+	})
+
+	SshSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "slurp",
+		Name:      "ssh_sessions",
+		Help:      "Open ssh connections.",
+	})
+
+	// rsync exit codes, "signal" if it was killed
+	RsyncExits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "slurp",
+		Name:      "rsync_exits_total",
+		Help:      "Rsync server exits by exit code.",
+	}, []string{"code"})
+
+	// stages seeded from the local cache (hit) or the backend (miss)
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "slurp",
+		Name:      "cache_lookups_total",
+		Help:      "Build cache lookups by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(Operations, OperationDuration, BackendDuration,
+		BackendRead, BackendWritten, BackendErrors, Stages, SshSessions,
+		RsyncExits, CacheLookups)
+}
+
+// Handler serves the metrics in the prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Observe records the result and duration of a stage operation started at start.
+func Observe(op string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	Operations.WithLabelValues(op, result).Inc()
+	OperationDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
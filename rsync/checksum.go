@@ -0,0 +1,86 @@
+package rsync
+
+import (
+	"encoding/binary"
+	"hash"
+
+	"golang.org/x/crypto/md4"
+)
+
+// block sizing, as rsync picks it for protocol 27
+const (
+	blockSize    = 700     // BLOCK_SIZE, the smallest block
+	maxBlockSize = 1 << 17 // MAX_BLOCK_SIZE, well under the protocol's limit
+	sumLength    = md4.Size
+)
+
+// rollingSum is rsync's weak checksum (get_checksum1), over signed bytes.
+func rollingSum(p []byte) uint32 {
+	var s1, s2 uint32
+	for _, b := range p {
+		s1 += uint32(int8(b))
+		s2 += s1
+	}
+	return s1&0xffff | s2<<16
+}
+
+// strongSum is a block's strong checksum (get_checksum2): md4 of the block
+// followed by the seed.
+func strongSum(p []byte, seed int32) []byte {
+	h := md4.New()
+	h.Write(p)
+	if seed != 0 {
+		var s [4]byte
+		binary.LittleEndian.PutUint32(s[:], uint32(seed))
+		h.Write(s[:])
+	}
+	return h.Sum(nil)
+}
+
+// fileSum starts a whole file checksum (sum_init): md4 of the seed followed by
+// the file.
+func fileSum(seed int32) hash.Hash {
+	h := md4.New()
+	var s [4]byte
+	binary.LittleEndian.PutUint32(s[:], uint32(seed))
+	h.Write(s[:])
+	return h
+}
+
+// sumHead describes the block checksums of a basis file.
+type sumHead struct {
+	count     int32 // number of blocks
+	blength   int32 // block length
+	s2length  int32 // bytes of each strong checksum
+	remainder int32 // length of the last block, if short
+}
+
+// newSumHead sizes the blocks of a basis file of size bytes, roughly its
+// square root like rsync does.
+func newSumHead(size int64) sumHead {
+	if size <= 0 {
+		return sumHead{}
+	}
+
+	blength := int64(blockSize)
+	if size > blockSize*blockSize {
+		for blength*blength < size && blength < maxBlockSize {
+			blength += 8
+		}
+	}
+
+	return sumHead{
+		count:     int32((size + blength - 1) / blength),
+		blength:   int32(blength),
+		s2length:  sumLength,
+		remainder: int32(size % blength),
+	}
+}
+
+// blockLen is the length of block i
+func (self sumHead) blockLen(i int32) int64 {
+	if i == self.count-1 && self.remainder != 0 {
+		return int64(self.remainder)
+	}
+	return int64(self.blength)
+}
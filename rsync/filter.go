@@ -0,0 +1,140 @@
+package rsync
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// filterRule is an include or exclude rule sent by the sender. The receiver
+// only uses them to spare excluded files from deletion.
+type filterRule struct {
+	exclude bool
+	dirOnly bool
+	base    bool // match the base name rather than the path
+	match   *regexp.Regexp
+}
+
+// receiveFilters reads the sender's filter rules (recv_filter_list). Before
+// protocol 29 rules are "- pattern", "+ pattern", "!" or a bare exclude.
+func receiveFilters(r *reader) ([]filterRule, error) {
+	var rules []filterRule
+
+	for {
+		l, err := r.readInt()
+		if err != nil {
+			return nil, err
+		}
+		if l == 0 {
+			return rules, nil
+		}
+		if l < 0 || l > maxPathLen {
+			return nil, fail(exitProtocol, "Invalid filter rule length")
+		}
+
+		b, err := r.readBuf(int(l))
+		if err != nil {
+			return nil, err
+		}
+		line := string(b)
+
+		switch {
+		case line == "!":
+			rules = nil
+			continue
+		case strings.HasPrefix(line, "- "):
+			line = line[2:]
+			rules = append(rules, newFilterRule(line, true))
+		case strings.HasPrefix(line, "+ "):
+			line = line[2:]
+			rules = append(rules, newFilterRule(line, false))
+		default:
+			rules = append(rules, newFilterRule(line, true))
+		}
+	}
+}
+
+// newFilterRule compiles an rsync pattern. A leading '/' anchors it to the top
+// of the transfer, a trailing '/' only matches directories, and a pattern
+// without a '/' matches the base name.
+func newFilterRule(pattern string, exclude bool) filterRule {
+	rule := filterRule{exclude: exclude}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimLeft(pattern, "/")
+	rule.base = !anchored && !strings.Contains(pattern, "/")
+
+	var expr strings.Builder
+	switch {
+	case anchored || rule.base:
+		expr.WriteString("^")
+	default:
+		expr.WriteString("(^|/)")
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+
+	var err error
+	rule.match, err = regexp.Compile(expr.String())
+	if err != nil {
+		// an unusable pattern protects everything rather than nothing
+		rule.match = regexp.MustCompile("")
+	}
+
+	return rule
+}
+
+// excluded reports whether the first rule matching name excludes it.
+func excluded(rules []filterRule, name string, isDir bool) bool {
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		subject := name
+		if rule.base {
+			subject = path.Base(name)
+		}
+		if rule.match.MatchString(subject) {
+			return rule.exclude
+		}
+	}
+	return false
+}
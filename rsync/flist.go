@@ -0,0 +1,282 @@
+package rsync
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// file list entry flags, protocol 27
+const (
+	xmitTopDir      = 1 << 0
+	xmitSameMode    = 1 << 1
+	xmitSameRdev    = 1 << 2
+	xmitSameUid     = 1 << 3
+	xmitSameGid     = 1 << 4
+	xmitSameName    = 1 << 5
+	xmitLongName    = 1 << 6
+	xmitSameTime    = 1 << 7
+	maxPathLen      = 4096
+	modeTypeMask    = 0170000
+	modeDir         = 0040000
+	modeRegular     = 0100000
+	modeSymlink     = 0120000
+	modeBlockDevice = 0060000
+	modeCharDevice  = 0020000
+)
+
+// file is an entry of the sender's file list
+type file struct {
+	name  string // slash separated, relative to the destination
+	size  int64
+	mtime time.Time
+	mode  uint32 // unix mode, type included
+	uid   int32
+	gid   int32
+	link  string // symlink target
+}
+
+func (self *file) isDir() bool {
+	return self.mode&modeTypeMask == modeDir
+}
+
+func (self *file) isRegular() bool {
+	return self.mode&modeTypeMask == modeRegular
+}
+
+func (self *file) isSymlink() bool {
+	return self.mode&modeTypeMask == modeSymlink
+}
+
+func (self *file) isDevice() bool {
+	t := self.mode & modeTypeMask
+	return t == modeBlockDevice || t == modeCharDevice
+}
+
+// perm converts the unix permission bits to an os.FileMode
+func (self *file) perm() os.FileMode {
+	mode := os.FileMode(self.mode & 0777)
+	if self.mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if self.mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if self.mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// fileList is the sender's file list, in the order both sides index it by
+type fileList struct {
+	files   []*file
+	users   map[int32]string // owner names by sender uid
+	groups  map[int32]string // group names by sender gid
+	ioError int32            // the sender failed to read some files
+}
+
+// receiveFileList reads the file list (recv_file_list), followed by the owner
+// names and the sender's io error flag, and sorts it like the sender does.
+func receiveFileList(r *reader, opts *Options) (*fileList, error) {
+	list := &fileList{users: map[int32]string{}, groups: map[int32]string{}}
+
+	// fields not sent again when unchanged
+	last := &file{}
+
+	for {
+		flags, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if flags == 0 {
+			break
+		}
+
+		f, err := receiveFile(r, opts, flags, last)
+		if err != nil {
+			return nil, err
+		}
+		list.files = append(list.files, f)
+		last = f
+	}
+
+	if opts.Owner && !opts.NumericIds {
+		err := receiveIdList(r, list.users)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Group && !opts.NumericIds {
+		err := receiveIdList(r, list.groups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	list.ioError, err = r.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	// protocols before 29 sort by plain byte comparison of the whole name
+	sort.SliceStable(list.files, func(i, j int) bool {
+		return list.files[i].name < list.files[j].name
+	})
+
+	return list, nil
+}
+
+// receiveFile reads a file list entry (receive_file_entry)
+func receiveFile(r *reader, opts *Options, flags byte, last *file) (*file, error) {
+	f := &file{mtime: last.mtime, mode: last.mode, uid: last.uid, gid: last.gid}
+
+	// the name, sharing a prefix with the last one
+	var prefix int
+	if flags&xmitSameName != 0 {
+		l, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		prefix = int(l)
+	}
+
+	var suffix int
+	if flags&xmitLongName != 0 {
+		l, err := r.readInt()
+		if err != nil {
+			return nil, err
+		}
+		suffix = int(l)
+	} else {
+		l, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		suffix = int(l)
+	}
+
+	if prefix > len(last.name) || suffix < 0 || prefix+suffix > maxPathLen {
+		return nil, fail(exitProtocol, "Invalid file name length in file list")
+	}
+	b, err := r.readBuf(suffix)
+	if err != nil {
+		return nil, err
+	}
+	f.name, err = cleanName(last.name[:prefix] + string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	f.size, err = r.readLongint()
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&xmitSameTime == 0 {
+		t, err := r.readInt()
+		if err != nil {
+			return nil, err
+		}
+		f.mtime = time.Unix(int64(uint32(t)), 0)
+	}
+
+	if flags&xmitSameMode == 0 {
+		m, err := r.readInt()
+		if err != nil {
+			return nil, err
+		}
+		f.mode = uint32(m)
+	}
+
+	if opts.Owner && flags&xmitSameUid == 0 {
+		f.uid, err = r.readInt()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Group && flags&xmitSameGid == 0 {
+		f.gid, err = r.readInt()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// device numbers aren't used, devices aren't recreated
+	t := f.mode & modeTypeMask
+	special := t != modeDir && t != modeRegular && t != modeSymlink && !f.isDevice()
+	if (opts.Devices && f.isDevice()) || (opts.Specials && special) {
+		if flags&xmitSameRdev == 0 {
+			_, err = r.readInt()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.Links && f.isSymlink() {
+		l, err := r.readInt()
+		if err != nil {
+			return nil, err
+		}
+		if l < 0 || l > maxPathLen {
+			return nil, fail(exitProtocol, "Invalid symlink length in file list")
+		}
+		b, err := r.readBuf(int(l))
+		if err != nil {
+			return nil, err
+		}
+		f.link = string(b)
+	}
+
+	return f, nil
+}
+
+// receiveIdList reads the names of the owners or groups in the file list
+func receiveIdList(r *reader, names map[int32]string) error {
+	for {
+		id, err := r.readInt()
+		if err != nil {
+			return err
+		}
+		if id == 0 {
+			return nil
+		}
+
+		l, err := r.readByte()
+		if err != nil {
+			return err
+		}
+		name, err := r.readBuf(int(l))
+		if err != nil {
+			return err
+		}
+		names[id] = string(name)
+	}
+}
+
+// cleanName makes a file list name relative and refuses any that would
+// climb out of the destination.
+func cleanName(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", fail(exitProtocol, "Invalid file name in file list")
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fail(exitProtocol, "File name '%v' escapes the destination", name)
+		}
+	}
+
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		name = "."
+	}
+
+	return name, nil
+}
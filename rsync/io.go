@@ -0,0 +1,100 @@
+package rsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// multiplexed message tags
+const (
+	msgData  = 0 // MSG_DATA, part of the data stream
+	msgInfo  = 2 // MSG_INFO, shown to the user
+	msgError = 3 // MSG_ERROR, shown to the user as an error
+
+	mplexBase  = 7        // added to the tag in the header
+	maxMsgSize = 0xffffff // the length is 24 bits
+)
+
+// ndxDone ends a phase, and the run
+const ndxDone = -1
+
+// reader decodes the sender's (unmultiplexed) stream. All numbers are little
+// endian.
+type reader struct {
+	r *bufio.Reader
+}
+
+func newReader(r io.Reader) *reader {
+	return &reader{bufio.NewReaderSize(r, 32*1024)}
+}
+
+func (self *reader) readByte() (byte, error) {
+	return self.r.ReadByte()
+}
+
+func (self *reader) readInt() (int32, error) {
+	var b [4]byte
+	_, err := io.ReadFull(self.r, b[:])
+	return int32(binary.LittleEndian.Uint32(b[:])), err
+}
+
+// readLongint reads an int32, or an int64 if the int32 is -1
+func (self *reader) readLongint() (int64, error) {
+	n, err := self.readInt()
+	if err != nil || n != -1 {
+		return int64(n), err
+	}
+
+	var b [8]byte
+	_, err = io.ReadFull(self.r, b[:])
+	return int64(binary.LittleEndian.Uint64(b[:])), err
+}
+
+func (self *reader) readBuf(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(self.r, b)
+	return b, err
+}
+
+// mux multiplexes writes to the sender, so messages can be interleaved with
+// the data stream. Each message is written whole.
+type mux struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// send writes p as messages of type tag
+func (self *mux) send(tag byte, p []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for first := true; first || len(p) > 0; first = false {
+		n := len(p)
+		if n > maxMsgSize {
+			n = maxMsgSize
+		}
+
+		var hdr [4]byte
+		binary.LittleEndian.PutUint32(hdr[:], uint32(mplexBase+int(tag))<<24|uint32(n))
+		_, err := self.w.Write(append(hdr[:], p[:n]...))
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+
+	return nil
+}
+
+// buffer encodes data for the sender, to be sent with mux.send
+type buffer []byte
+
+func (self *buffer) writeInt(n int32) {
+	*self = binary.LittleEndian.AppendUint32(*self, uint32(n))
+}
+
+func (self *buffer) write(p []byte) {
+	*self = append(*self, p...)
+}
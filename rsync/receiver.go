@@ -0,0 +1,663 @@
+package rsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nanobox-io/slurp/config"
+)
+
+// the redo phase resends files that failed verification
+const maxPhase = 1
+
+// receiver is the state of one push into a destination directory. Like rsync
+// it is split in two: the generator tells the sender which files it wants
+// (with checksums of what it already has), the receiver rebuilds them from
+// the sender's deltas.
+type receiver struct {
+	dir  string
+	opts *Options
+	in   *reader
+	out  *mux
+	seed int32
+
+	list    *fileList
+	filters []filterRule
+
+	// files to resend at the end of the first phase
+	redo chan []int32
+
+	// closed once the receiver has read the last of the sender's data
+	done chan struct{}
+
+	// set by local failures the transfer carried on after
+	partial int32
+}
+
+// Receive runs an rsync receiver on in and out (the ssh channel), storing
+// what the sender pushes in dir. Errors are sent to the sender as well as
+// returned.
+func Receive(in io.Reader, out io.Writer, dir string, opts Options) error {
+	self := &receiver{
+		dir:  dir,
+		opts: &opts,
+		in:   newReader(in),
+		redo: make(chan []int32, 1),
+		done: make(chan struct{}),
+	}
+
+	err := self.handshake(out)
+	if err != nil {
+		return err
+	}
+	self.out = &mux{w: out}
+
+	err = self.run()
+	if err != nil {
+		self.out.send(msgError, []byte(fmt.Sprintf("slurp: %v\n", err)))
+		return err
+	}
+	if atomic.LoadInt32(&self.partial) != 0 {
+		return fail(exitPartial, "Some files could not be transferred")
+	}
+
+	return nil
+}
+
+// handshake exchanges protocol versions and sends the checksum seed, the
+// last that is sent unmultiplexed.
+func (self *receiver) handshake(out io.Writer) error {
+	var b [4]byte
+	err := binary.Read(rand.Reader, binary.LittleEndian, &self.seed)
+	if err != nil {
+		return err
+	}
+	if self.seed == 0 {
+		self.seed = 1
+	}
+
+	binary.LittleEndian.PutUint32(b[:], ProtocolVersion)
+	_, err = out.Write(b[:])
+	if err != nil {
+		return err
+	}
+
+	remote, err := self.in.readInt()
+	if err != nil {
+		return err
+	}
+	if remote < ProtocolVersion {
+		return fail(exitProtocol, "Protocol version %d is too old, %d is required", remote, ProtocolVersion)
+	}
+
+	binary.LittleEndian.PutUint32(b[:], uint32(self.seed))
+	_, err = out.Write(b[:])
+	return err
+}
+
+// run receives the filter rules and file list, then generates and receives
+// the files.
+func (self *receiver) run() error {
+	var err error
+
+	if self.opts.Delete && !self.opts.DeleteExcluded {
+		self.filters, err = receiveFilters(self.in)
+		if err != nil {
+			return err
+		}
+	}
+
+	self.list, err = receiveFileList(self.in, self.opts)
+	if err != nil {
+		return err
+	}
+	config.Log.Trace("Received file list of %d file(s)", len(self.list.files))
+
+	genErr := make(chan error, 1)
+	go func() {
+		genErr <- self.generate()
+	}()
+
+	err = self.receive()
+	close(self.done)
+	if err != nil {
+		return err
+	}
+
+	return <-genErr
+}
+
+// generate creates directories and symlinks, removes what the sender doesn't
+// have, and asks for the files that differ.
+func (self *receiver) generate() error {
+	if self.opts.Delete {
+		self.deleteExtraneous()
+	}
+
+	for i, f := range self.list.files {
+		err := self.generateFile(int32(i), f)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := self.sendNdx(ndxDone)
+	if err != nil {
+		return err
+	}
+
+	// resend what failed verification, unless the receiver gave up
+	select {
+	case redo := <-self.redo:
+		for _, ndx := range redo {
+			err = self.requestFile(ndx, self.list.files[ndx])
+			if err != nil {
+				return err
+			}
+		}
+	case <-self.done:
+	}
+
+	err = self.sendNdx(ndxDone)
+	if err != nil {
+		return err
+	}
+
+	<-self.done
+
+	// directories last, creating their contents changed them
+	for i := len(self.list.files) - 1; i >= 0; i-- {
+		f := self.list.files[i]
+		if f.isDir() {
+			self.setAttrs(self.path(f), f, !self.opts.OmitDirTimes)
+		}
+	}
+
+	// goodbye
+	return self.sendNdx(ndxDone)
+}
+
+// generateFile brings one file list entry up to date, or asks for it.
+func (self *receiver) generateFile(ndx int32, f *file) error {
+	path, err := self.safePath(f.name)
+	if err != nil {
+		return err
+	}
+
+	existing, statErr := os.Lstat(path)
+
+	// an entry of a different type is replaced
+	if statErr == nil && fileType(existing.Mode()) != f.mode&modeTypeMask {
+		err = os.RemoveAll(path)
+		if err != nil {
+			return self.warn("Failed to replace '%v' - %v", f.name, err)
+		}
+		statErr = os.ErrNotExist
+	}
+
+	switch {
+	case f.isDir():
+		if statErr != nil {
+			err = os.Mkdir(path, 0755)
+			if err != nil {
+				return self.warn("Failed to create directory '%v' - %v", f.name, err)
+			}
+		}
+
+	case f.isSymlink():
+		if !self.opts.Links {
+			return nil
+		}
+		if statErr == nil {
+			link, _ := os.Readlink(path)
+			if link == f.link {
+				self.setAttrs(path, f, false)
+				return nil
+			}
+			os.Remove(path)
+		}
+		// the target is kept as sent, even absolute or leading out of the
+		// stage, like rsync without --safe-links. Nothing is ever written
+		// through a symlink (see safePath), and builds store links as links.
+		err = os.Symlink(f.link, path)
+		if err != nil {
+			return self.warn("Failed to create symlink '%v' - %v", f.name, err)
+		}
+		self.setAttrs(path, f, false)
+
+	case f.isRegular():
+		if statErr == nil && self.unchanged(existing, f) {
+			self.setAttrs(path, f, true)
+			return nil
+		}
+		return self.requestFile(ndx, f)
+
+	default:
+		config.Log.Trace("Skipping non-regular file '%v'", f.name)
+	}
+
+	return nil
+}
+
+// unchanged is rsync's quick check
+func (self *receiver) unchanged(existing os.FileInfo, f *file) bool {
+	if existing.Size() != f.size {
+		return false
+	}
+	if self.opts.SizeOnly {
+		return true
+	}
+	if self.opts.IgnoreTimes {
+		return false
+	}
+	return existing.ModTime().Unix() == f.mtime.Unix()
+}
+
+// requestFile asks the sender for a file, sending the block checksums of the
+// local copy (the basis) so only the differences come back.
+func (self *receiver) requestFile(ndx int32, f *file) error {
+	var buf buffer
+	buf.writeInt(ndx)
+
+	basis, head := self.openBasis(f)
+	buf.writeInt(head.count)
+	buf.writeInt(head.blength)
+	buf.writeInt(head.s2length)
+	buf.writeInt(head.remainder)
+
+	if basis != nil {
+		defer basis.Close()
+
+		block := make([]byte, head.blength)
+		for i := int32(0); i < head.count; i++ {
+			n, err := io.ReadFull(basis, block[:head.blockLen(i)])
+			if err != nil {
+				return fmt.Errorf("Failed to read '%v' - %v", f.name, err)
+			}
+
+			sum1 := rollingSum(block[:n])
+			buf.writeInt(int32(sum1))
+			buf.write(strongSum(block[:n], self.seed))
+		}
+	}
+
+	return self.out.send(msgData, buf)
+}
+
+// openBasis opens the local copy of a file to send checksums of, if any
+func (self *receiver) openBasis(f *file) (*os.File, sumHead) {
+	if self.opts.WholeFile {
+		return nil, sumHead{}
+	}
+
+	path, err := self.safePath(f.name)
+	if err != nil {
+		return nil, sumHead{}
+	}
+
+	basis, err := os.Open(path)
+	if err != nil {
+		return nil, sumHead{}
+	}
+
+	info, err := basis.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		basis.Close()
+		return nil, sumHead{}
+	}
+
+	return basis, newSumHead(info.Size())
+}
+
+// receive reads the files the sender sends in reply to the generator.
+func (self *receiver) receive() error {
+	phase := 0
+	var redo []int32
+
+	for {
+		ndx, err := self.in.readInt()
+		if err != nil {
+			return err
+		}
+
+		if ndx == ndxDone {
+			phase++
+			if phase > maxPhase {
+				return nil
+			}
+			self.redo <- redo
+			redo = nil
+			continue
+		}
+
+		if ndx < 0 || int(ndx) >= len(self.list.files) || !self.list.files[ndx].isRegular() {
+			return fail(exitProtocol, "Invalid file index %d", ndx)
+		}
+		f := self.list.files[ndx]
+
+		ok, err := self.receiveFile(f)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+
+		if phase == 0 {
+			config.Log.Debug("'%v' failed verification, resending", f.name)
+			redo = append(redo, ndx)
+		} else {
+			self.warn("'%v' failed verification, update discarded", f.name)
+		}
+	}
+}
+
+// receiveFile rebuilds a file from literal data and blocks of the basis,
+// reporting whether it matched the sender's checksum.
+func (self *receiver) receiveFile(f *file) (bool, error) {
+	var head sumHead
+	for _, v := range []*int32{&head.count, &head.blength, &head.s2length, &head.remainder} {
+		n, err := self.in.readInt()
+		if err != nil {
+			return false, err
+		}
+		*v = n
+	}
+	if head.count < 0 || head.blength < 0 || head.blength > maxBlockSize || head.remainder < 0 || head.remainder > head.blength {
+		return false, fail(exitProtocol, "Invalid checksum header for '%v'", f.name)
+	}
+
+	path, err := self.safePath(f.name)
+	if err != nil {
+		return false, err
+	}
+
+	var basis *os.File
+	if head.count > 0 {
+		basis, err = os.Open(path)
+		if err != nil {
+			return false, fail(exitFileIO, "Failed to open basis of '%v' - %v", f.name, err)
+		}
+		defer basis.Close()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return false, fail(exitFileIO, "Failed to create '%v' - %v", f.name, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// the destination grows by what the file outgrows the one it replaces
+	g := &growth{w: tmp, grow: self.opts.Grow}
+	if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+		g.old = info.Size()
+	}
+	kept := false
+	defer func() { g.done(kept) }()
+
+	sum := fileSum(self.seed)
+	w := io.MultiWriter(g, sum)
+
+	for {
+		token, err := self.in.readInt()
+		if err != nil {
+			return false, err
+		}
+
+		if token == 0 {
+			break
+		}
+
+		if token > 0 {
+			// literal data
+			_, err = io.CopyN(w, self.in.r, int64(token))
+			if err != nil {
+				return false, fmt.Errorf("Failed to write '%v' - %v", f.name, err)
+			}
+			continue
+		}
+
+		// a block of the basis
+		block := -(token + 1)
+		if block >= head.count {
+			return false, fail(exitProtocol, "Invalid block %d of '%v'", block, f.name)
+		}
+		_, err = io.Copy(w, io.NewSectionReader(basis, int64(block)*int64(head.blength), head.blockLen(block)))
+		if err != nil {
+			return false, fail(exitFileIO, "Failed to copy from basis of '%v' - %v", f.name, err)
+		}
+	}
+
+	remote, err := self.in.readBuf(sumLength)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(remote, sum.Sum(nil)) {
+		return false, nil
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return false, fail(exitFileIO, "Failed to write '%v' - %v", f.name, err)
+	}
+
+	self.setAttrs(tmp.Name(), f, true)
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return false, fail(exitFileIO, "Failed to rename '%v' - %v", f.name, err)
+	}
+	kept = true
+
+	return true, nil
+}
+
+// growth tells Options.Grow how much a file being received outgrows the one
+// it replaces, as it is written
+type growth struct {
+	w       io.Writer
+	grow    func(n int64) error
+	old     int64 // bytes of the file replaced
+	written int64
+}
+
+func (self *growth) Write(p []byte) (int, error) {
+	if self.grow != nil {
+		err := self.grow(self.outgrown(self.written+int64(len(p))) - self.outgrown(self.written))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := self.w.Write(p)
+	self.written += int64(len(p))
+	return n, err
+}
+
+// done settles what was told: a file kept in place of the old one grows the
+// destination by its size less the old one's, a discarded one not at all
+func (self *growth) done(kept bool) {
+	if self.grow == nil {
+		return
+	}
+	if kept {
+		self.grow(self.written - self.old - self.outgrown(self.written))
+	} else {
+		self.grow(-self.outgrown(self.written))
+	}
+}
+
+// outgrown is how many of n bytes lie past the old file's
+func (self *growth) outgrown(n int64) int64 {
+	if n > self.old {
+		return n - self.old
+	}
+	return 0
+}
+
+// deleteExtraneous removes, from every directory in the file list, what the
+// sender doesn't have. Excluded files are spared (--delete-excluded sends no
+// rules), and nothing is removed if the sender had trouble reading its files.
+func (self *receiver) deleteExtraneous() {
+	if self.list.ioError != 0 {
+		self.out.send(msgError, []byte("slurp: IO error encountered -- skipping file deletion\n"))
+		return
+	}
+
+	names := make(map[string]bool, len(self.list.files))
+	for _, f := range self.list.files {
+		names[f.name] = true
+	}
+
+	for _, f := range self.list.files {
+		if !f.isDir() {
+			continue
+		}
+
+		dir, err := self.safePath(f.name)
+		if err != nil {
+			continue
+		}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if f.name != "." {
+				name = f.name + "/" + name
+			}
+			if names[name] || excluded(self.filters, name, entry.IsDir()) {
+				continue
+			}
+
+			config.Log.Trace("Deleting '%v'", name)
+			err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				self.warn("Failed to delete '%v' - %v", name, err)
+			}
+		}
+	}
+}
+
+// setAttrs applies the preserved attributes of f to path. Ownership only
+// changes when running as root, like rsync.
+func (self *receiver) setAttrs(path string, f *file, withTime bool) {
+	if os.Geteuid() == 0 && (self.opts.Owner || self.opts.Group) {
+		uid, gid := -1, -1
+		if self.opts.Owner {
+			uid = self.mapId(f.uid, self.list.users, lookupUser)
+		}
+		if self.opts.Group {
+			gid = self.mapId(f.gid, self.list.groups, lookupGroup)
+		}
+		os.Lchown(path, uid, gid)
+	}
+
+	if f.isSymlink() {
+		return
+	}
+
+	if self.opts.Perms {
+		os.Chmod(path, f.perm())
+	}
+
+	if self.opts.Times && withTime {
+		os.Chtimes(path, f.mtime, f.mtime)
+	}
+}
+
+// mapId maps a sender's id to the local id of the same name, if any
+func (self *receiver) mapId(id int32, names map[int32]string, lookup func(string) (string, error)) int {
+	if name, ok := names[id]; ok {
+		local, err := lookup(name)
+		if err == nil {
+			if n, err := strconv.Atoi(local); err == nil {
+				return n
+			}
+		}
+	}
+	return int(id)
+}
+
+func lookupUser(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// safePath resolves a file list name within the destination, refusing names
+// beneath a symlink so a pushed link can't redirect later writes.
+func (self *receiver) safePath(name string) (string, error) {
+	path := filepath.Join(self.dir, filepath.FromSlash(name))
+
+	parts := strings.Split(name, "/")
+	parent := self.dir
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fail(exitFileIO, "'%v' is beneath a symlink", name)
+		}
+	}
+
+	return path, nil
+}
+
+// path is where a file list entry goes, having been checked by generateFile
+func (self *receiver) path(f *file) string {
+	return filepath.Join(self.dir, filepath.FromSlash(f.name))
+}
+
+// sendNdx sends a file index, or ndxDone
+func (self *receiver) sendNdx(ndx int32) error {
+	var buf buffer
+	buf.writeInt(ndx)
+	return self.out.send(msgData, buf)
+}
+
+// warn reports a failure the transfer can carry on after
+func (self *receiver) warn(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	config.Log.Debug("rsync: %v", msg)
+	atomic.StoreInt32(&self.partial, 1)
+	return self.out.send(msgError, []byte("slurp: "+msg+"\n"))
+}
+
+// fileType is the unix type bits of an os.FileMode
+func fileType(mode os.FileMode) uint32 {
+	switch {
+	case mode.IsDir():
+		return modeDir
+	case mode.IsRegular():
+		return modeRegular
+	case mode&os.ModeSymlink != 0:
+		return modeSymlink
+	case mode&os.ModeDevice != 0 && mode&os.ModeCharDevice != 0:
+		return modeCharDevice
+	case mode&os.ModeDevice != 0:
+		return modeBlockDevice
+	}
+	return 0
+}
@@ -0,0 +1,565 @@
+package rsync_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jcelliott/lumber"
+	"golang.org/x/crypto/md4"
+
+	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/rsync"
+)
+
+// the command rsync 3 runs on the server for `rsync -aR --delete . host:dir`
+const command = "rsync --server -vlogDtprRe.iLsfx --delete . build/"
+
+// bytes the receiver said its destinations grew by
+var grown int64
+
+func TestMain(m *testing.M) {
+	// the test binary is the remote shell of TestSystemRsync
+	if dst := os.Getenv("SLURP_RSYNC_DEST"); dst != "" {
+		os.Exit(remoteShell(dst))
+	}
+
+	os.RemoveAll("/tmp/slurpRsync")
+
+	config.LogLevel = "fatal"
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
+
+	rtn := m.Run()
+
+	os.RemoveAll("/tmp/slurpRsync")
+
+	os.Exit(rtn)
+}
+
+func TestParseCommand(t *testing.T) {
+	opts, err := rsync.ParseCommand(command)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if !opts.Links || !opts.Owner || !opts.Group || !opts.Times || !opts.Perms || !opts.Recursive || !opts.Delete {
+		t.Errorf("%+v doesn't match expected options", opts)
+	}
+	if strings.Join(opts.Args, " ") != ". build/" {
+		t.Errorf("%q doesn't match expected args", opts.Args)
+	}
+
+	for _, bad := range []string{"rsync --server -vlogDtprze.iLsfx . build/", "rsync --server --sender -vlogDtpre.iLsfx . build/", "ls -la"} {
+		_, err = rsync.ParseCommand(bad)
+		if err == nil {
+			t.Errorf("%q wasn't refused", bad)
+		}
+		if rsync.ExitCode(err) == 0 {
+			t.Errorf("%q refused without an exit code", bad)
+		}
+	}
+}
+
+func TestReceive(t *testing.T) {
+	src := "/tmp/slurpRsync/src"
+	dst := "/tmp/slurpRsync/dst"
+	os.MkdirAll(dst, 0755)
+
+	big := make([]byte, 200*1024)
+	rand.Read(big)
+	writeFile(t, src+"/big.bin", big, 0644)
+	writeFile(t, src+"/dir/script.sh", []byte("#!/bin/sh\necho hi\n"), 0755)
+	writeFile(t, src+"/dir/sub/empty", nil, 0600)
+	os.Symlink("dir/script.sh", src+"/link")
+
+	push(t, src, dst, false)
+	compareTrees(t, src, dst)
+
+	// change the middle of the big file, remove a file and leave junk behind
+	copy(big[100*1024:], []byte("changed in the middle"))
+	writeFile(t, src+"/big.bin", big, 0644)
+	os.Remove(src + "/dir/sub/empty")
+	writeFile(t, dst+"/stale.txt", []byte("stale"), 0644)
+	writeFile(t, dst+"/dir/keep.log", []byte("excluded"), 0644)
+
+	literal := push(t, src, dst, false)
+	if literal >= int64(len(big)) {
+		t.Errorf("%d literal bytes sent, the basis wasn't used", literal)
+	}
+
+	_, err := os.Stat(dst + "/stale.txt")
+	if !os.IsNotExist(err) {
+		t.Errorf("extraneous file not deleted - %v", err)
+	}
+	_, err = os.Stat(dst + "/dir/keep.log")
+	if err != nil {
+		t.Errorf("excluded file deleted - %v", err)
+	}
+	compareTrees(t, src, dst)
+
+	// a file failing verification is resent
+	big[0]++
+	writeFile(t, src+"/big.bin", big, 0644)
+	push(t, src, dst, true)
+	compareTrees(t, src, dst)
+}
+
+func TestReceiveGrow(t *testing.T) {
+	src := "/tmp/slurpRsync/grow-src"
+	dst := "/tmp/slurpRsync/grow-dst"
+
+	writeFile(t, src+"/file", bytes.Repeat([]byte("s"), 10), 0644)
+	writeFile(t, src+"/new", bytes.Repeat([]byte("n"), 50), 0644)
+	writeFile(t, dst+"/file", bytes.Repeat([]byte("d"), 100), 0644)
+
+	// a file replaced with a smaller one is counted back
+	grown = 0
+	push(t, src, dst, false)
+	compareTrees(t, src, dst)
+	if grown != 50-90 {
+		t.Errorf("%d doesn't match expected growth", grown)
+	}
+
+	// a file resent after failing verification is only counted once
+	writeFile(t, src+"/file", bytes.Repeat([]byte("S"), 30), 0644)
+	grown = 0
+	push(t, src, dst, true)
+	compareTrees(t, src, dst)
+	if grown != 20 {
+		t.Errorf("%d doesn't match expected growth", grown)
+	}
+}
+
+func TestSystemRsync(t *testing.T) {
+	bin, err := exec.LookPath("rsync")
+	if err != nil {
+		t.Skip("No rsync binary")
+	}
+	shell, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := "/tmp/slurpRsync/system-src"
+	dst := "/tmp/slurpRsync/system-dst"
+	os.MkdirAll(dst, 0755)
+
+	big := make([]byte, 200*1024)
+	rand.Read(big)
+	writeFile(t, src+"/big.bin", big, 0644)
+	writeFile(t, src+"/dir/script.sh", []byte("#!/bin/sh\necho hi\n"), 0755)
+	os.Symlink("dir/script.sh", src+"/link")
+
+	run := func() {
+		cmd := exec.Command(bin, "-a", "--delete", "-e", shell, src+"/", "host:"+dst+"/")
+		cmd.Env = append(os.Environ(), "SLURP_RSYNC_DEST="+dst)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v - %s", err, out)
+		}
+	}
+
+	run()
+	compareTrees(t, src, dst)
+
+	// a change against the basis, and junk to delete
+	copy(big[100*1024:], []byte("changed in the middle"))
+	writeFile(t, src+"/big.bin", big, 0644)
+	writeFile(t, dst+"/stale.txt", []byte("stale"), 0644)
+
+	run()
+	compareTrees(t, src, dst)
+	if _, err := os.Lstat(dst + "/stale.txt"); !os.IsNotExist(err) {
+		t.Errorf("extraneous file not deleted - %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVS
+////////////////////////////////////////////////////////////////////////////////
+
+// entry is a file of the sender's file list
+type entry struct {
+	name string
+	info os.FileInfo
+	link string
+}
+
+// push runs a protocol 27 sender against the receiver, returning how many
+// literal bytes were sent. If corrupt, the first file sent has a bad checksum.
+func push(t *testing.T, src, dst string, corrupt bool) int64 {
+	opts, err := rsync.ParseCommand(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Grow = func(n int64) error {
+		grown += n
+		return nil
+	}
+
+	toServer, fromClient := io.Pipe()
+	fromServer, toClient := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		err := rsync.Receive(toServer, toClient, dst, *opts)
+		toClient.Close()
+		done <- err
+	}()
+
+	w := bufio.NewWriter(fromClient)
+	r := bufio.NewReader(fromServer)
+
+	// handshake, then the server multiplexes. pipes don't buffer, so read the
+	// server's version before sending ours.
+	if v := readInt(t, r); v != rsync.ProtocolVersion {
+		t.Fatalf("%d doesn't match expected protocol", v)
+	}
+	writeInt(w, 31)
+	w.Flush()
+	seed := readInt(t, r)
+	data, messages := demux(r)
+
+	// filter rules, the file list, owner names and the io error flag
+	writeString(w, "- *.log")
+	writeInt(w, 0)
+
+	files := walk(t, src)
+	sendFileList(w, files)
+	writeInt(w, 0)
+	writeInt(w, 0)
+	writeInt(w, 0)
+	w.Flush()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	var literal int64
+	phase := 0
+	for {
+		ndx := readInt(t, data)
+		if ndx == -1 {
+			phase++
+			if phase > 1 {
+				break
+			}
+			writeInt(w, -1)
+			w.Flush()
+			continue
+		}
+
+		head := make([]int32, 4)
+		for i := range head {
+			head[i] = readInt(t, data)
+		}
+		sums := map[uint32][]int{}
+		strong := make([][]byte, head[0])
+		for i := int32(0); i < head[0]; i++ {
+			sum1 := uint32(readInt(t, data))
+			sums[sum1] = append(sums[sum1], int(i))
+			strong[i] = make([]byte, head[2])
+			io.ReadFull(data, strong[i])
+		}
+
+		content, _ := ioutil.ReadFile(filepath.Join(src, files[ndx].name))
+
+		writeInt(w, ndx)
+		for _, v := range head {
+			writeInt(w, v)
+		}
+		literal += sendDelta(w, content, head, sums, strong, seed)
+
+		h := md4.New()
+		binary.Write(h, binary.LittleEndian, seed)
+		h.Write(content)
+		sum := h.Sum(nil)
+		if corrupt {
+			sum[0]++
+			corrupt = false
+		}
+		w.Write(sum)
+		w.Flush()
+	}
+
+	writeInt(w, -1)
+	w.Flush()
+
+	if v := readInt(t, data); v != -1 {
+		t.Errorf("%d doesn't match expected goodbye", v)
+	}
+	fromClient.Close()
+
+	err = <-done
+	if err != nil {
+		t.Errorf("%v - %s", err, messages.String())
+	}
+	return literal
+}
+
+// remoteShell receives a push into dst as the system rsync's remote shell,
+// which it runs as `<shell> host rsync --server ...`
+func remoteShell(dst string) int {
+	config.LogLevel = "fatal"
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
+
+	args := os.Args[1:]
+	for len(args) > 0 && args[0] != "rsync" {
+		args = args[1:]
+	}
+
+	opts, err := rsync.ParseCommand(strings.Join(args, " "))
+	if err == nil {
+		err = rsync.Receive(os.Stdin, os.Stdout, dst, *opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "slurp: %v\n", err)
+	}
+	return rsync.ExitCode(err)
+}
+
+// sendDelta sends content as literal data and matching blocks of the basis
+func sendDelta(w io.Writer, content []byte, head []int32, sums map[uint32][]int, strong [][]byte, seed int32) int64 {
+	var literal []byte
+	var sent int64
+
+	flush := func() {
+		for len(literal) > 0 {
+			n := len(literal)
+			if n > 32*1024 {
+				n = 32 * 1024
+			}
+			writeInt(w, int32(n))
+			w.Write(literal[:n])
+			sent += int64(n)
+			literal = literal[n:]
+		}
+	}
+
+	for off := 0; off < len(content); {
+		matched := false
+		for _, i := range sums[rolling(content[off:min(off+int(head[1]), len(content))])] {
+			blen := int(head[1])
+			if i == int(head[0])-1 && head[3] != 0 {
+				blen = int(head[3])
+			}
+			if off+blen > len(content) {
+				continue
+			}
+
+			block := content[off : off+blen]
+			h := md4.New()
+			h.Write(block)
+			binary.Write(h, binary.LittleEndian, seed)
+			if rolling(block) == rolling(content[off:min(off+int(head[1]), len(content))]) && bytes.Equal(h.Sum(nil)[:head[2]], strong[i]) {
+				flush()
+				writeInt(w, int32(-(i + 1)))
+				off += blen
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			literal = append(literal, content[off])
+			off++
+		}
+	}
+	flush()
+	writeInt(w, 0)
+
+	return sent
+}
+
+// sendFileList sends the entries, sharing name prefixes and unchanged fields
+func sendFileList(w *bufio.Writer, files []entry) {
+	var last entry
+	var lastMode, lastTime int32
+
+	for _, f := range files {
+		mode := unixMode(f.info)
+		mtime := int32(f.info.ModTime().Unix())
+
+		prefix := 0
+		for prefix < len(last.name) && prefix < len(f.name) && prefix < 255 && last.name[prefix] == f.name[prefix] {
+			prefix++
+		}
+
+		flags := byte(1 << 6) // long name
+		if prefix > 0 {
+			flags |= 1 << 5
+		}
+		if last.info != nil && mode == lastMode {
+			flags |= 1 << 1
+		}
+		if last.info != nil && mtime == lastTime {
+			flags |= 1 << 7
+		}
+		flags |= 1<<3 | 1<<4 // same owner and group, all 0
+
+		w.WriteByte(flags)
+		if prefix > 0 {
+			w.WriteByte(byte(prefix))
+		}
+		writeString(w, f.name[prefix:])
+		size := f.info.Size()
+		if f.info.IsDir() {
+			size = 0
+		}
+		writeInt(w, int32(size))
+		if flags&(1<<7) == 0 {
+			writeInt(w, mtime)
+		}
+		if flags&(1<<1) == 0 {
+			writeInt(w, mode)
+		}
+		if f.link != "" {
+			writeString(w, f.link)
+		}
+
+		last, lastMode, lastTime = f, mode, mtime
+	}
+	w.WriteByte(0)
+}
+
+// walk lists a tree like a sender would, "." first
+func walk(t *testing.T, src string) []entry {
+	var files []entry
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		f := entry{name: rel, info: info}
+		if info.Mode()&os.ModeSymlink != 0 {
+			f.link, _ = os.Readlink(path)
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send out of order, the receiver has to sort them like the sender
+	files[1], files[len(files)-1] = files[len(files)-1], files[1]
+	return files
+}
+
+// demux splits the server's multiplexed output into data and messages
+func demux(r io.Reader) (io.Reader, *bytes.Buffer) {
+	pr, pw := io.Pipe()
+	messages := &bytes.Buffer{}
+	go func() {
+		for {
+			var hdr [4]byte
+			_, err := io.ReadFull(r, hdr[:])
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			v := binary.LittleEndian.Uint32(hdr[:])
+			body := make([]byte, v&0xffffff)
+			io.ReadFull(r, body)
+			if v>>24 == 7 {
+				pw.Write(body)
+			} else {
+				messages.Write(body)
+			}
+		}
+	}()
+	return pr, messages
+}
+
+// compareTrees checks dst matches src: contents, modes, times and links
+func compareTrees(t *testing.T, src, dst string) {
+	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(src, path)
+		got, err := os.Lstat(filepath.Join(dst, rel))
+		if err != nil {
+			t.Errorf("'%v' missing - %v", rel, err)
+			return nil
+		}
+
+		if got.Mode() != info.Mode() {
+			t.Errorf("'%v' mode %v doesn't match %v", rel, got.Mode(), info.Mode())
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			want, _ := os.Readlink(path)
+			link, _ := os.Readlink(filepath.Join(dst, rel))
+			if link != want {
+				t.Errorf("'%v' links to %q, not %q", rel, link, want)
+			}
+		case info.Mode().IsRegular():
+			want, _ := ioutil.ReadFile(path)
+			content, _ := ioutil.ReadFile(filepath.Join(dst, rel))
+			if !bytes.Equal(content, want) {
+				t.Errorf("'%v' content doesn't match", rel)
+			}
+			fallthrough
+		default:
+			if got.ModTime().Unix() != info.ModTime().Unix() {
+				t.Errorf("'%v' mtime %v doesn't match %v", rel, got.ModTime(), info.ModTime())
+			}
+		}
+		return nil
+	})
+}
+
+var writes int
+
+func writeFile(t *testing.T, path string, content []byte, mode os.FileMode) {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	err := ioutil.WriteFile(path, content, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(path, mode)
+	// a distinct time for every write, so a rewrite of the same size within
+	// the same second still fails the quick check
+	writes++
+	mtime := time.Now().Add(-time.Duration(writes) * time.Minute)
+	os.Chtimes(path, mtime, mtime)
+}
+
+func unixMode(info os.FileInfo) int32 {
+	return int32(info.Sys().(*syscall.Stat_t).Mode)
+}
+
+func rolling(p []byte) uint32 {
+	var s1, s2 uint32
+	for _, b := range p {
+		s1 += uint32(int8(b))
+		s2 += s1
+	}
+	return s1&0xffff | s2<<16
+}
+
+func writeInt(w io.Writer, n int32) {
+	binary.Write(w, binary.LittleEndian, n)
+}
+
+func writeString(w io.Writer, s string) {
+	writeInt(w, int32(len(s)))
+	io.WriteString(w, s)
+}
+
+func readInt(t *testing.T, r io.Reader) int32 {
+	var n int32
+	err := binary.Read(r, binary.LittleEndian, &n)
+	if err != nil {
+		panic(fmt.Sprintf("read failed - %v", err))
+	}
+	return n
+}
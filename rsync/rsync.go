@@ -0,0 +1,185 @@
+// Package "rsync" is an embedded rsync receiver, the side of `rsync --server`
+// a push talks to. It speaks protocol 27, which every rsync since 2.6 can
+// negotiate down to, so it needs neither incremental recursion nor the newer
+// varint encodings. Compression, hard links, checksums and the like are
+// refused up front rather than misunderstood on the wire.
+package rsync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion is the rsync protocol version the receiver speaks.
+const ProtocolVersion = 27
+
+// exit codes, as rsync reports them
+const (
+	exitSyntax      = 1  // RERR_SYNTAX
+	exitProtocol    = 2  // RERR_PROTOCOL
+	exitUnsupported = 4  // RERR_UNSUPPORTED
+	exitFileIO      = 11 // RERR_FILEIO
+	exitStreamIO    = 12 // RERR_STREAMIO
+	exitPartial     = 23 // RERR_PARTIAL
+)
+
+// Error is an rsync failure along with the exit code rsync would report it with.
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (self *Error) Error() string {
+	return self.Err.Error()
+}
+
+// ExitCode is the rsync exit code for err, 0 if nil.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var rerr *Error
+	if errors.As(err, &rerr) {
+		return rerr.Code
+	}
+	return exitStreamIO
+}
+
+// fail wraps an error with its exit code
+func fail(code int, format string, args ...interface{}) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// Options are the parts of the server command line the receiver honours.
+type Options struct {
+	Links          bool // -l, recreate symlinks
+	Owner          bool // -o, preserve owner (when running as root)
+	Group          bool // -g, preserve group (when running as root)
+	Devices        bool // -D/--devices, the file list carries device numbers
+	Specials       bool // -D/--specials, the file list carries special files
+	Times          bool // -t, preserve modification times
+	OmitDirTimes   bool // -O, but not on directories
+	Perms          bool // -p, preserve permissions
+	Recursive      bool // -r
+	Delete         bool // --delete*, remove files the sender doesn't have
+	DeleteExcluded bool // --delete-excluded, excluded files aren't protected
+	NumericIds     bool // --numeric-ids, owners aren't mapped by name
+	IgnoreTimes    bool // -I, transfer files even if size and time match
+	SizeOnly       bool // --size-only, skip files whose size matches
+	WholeFile      bool // -W, never send block checksums
+
+	Args []string // arguments after the options, "." and the destination
+
+	// Grow, if set, is told how many bytes the destination grows by as files
+	// are written, and shrinks by as they replace larger ones. An error stops
+	// the transfer.
+	Grow func(n int64) error
+}
+
+// ParseCommand parses the command a client asks an ssh server to run for a
+// push, eg. `rsync --server -vlogDtprRe.iLsfx --delete . dest/`, refusing
+// options the receiver doesn't support.
+func ParseCommand(command string) (*Options, error) {
+	args := strings.Fields(command)
+	if len(args) < 2 || args[0] != "rsync" || args[1] != "--server" {
+		return nil, fail(exitSyntax, "Not an rsync server command")
+	}
+
+	opts := &Options{}
+	for i := 2; i < len(args); i++ {
+		arg := args[i]
+
+		switch {
+		case arg == "--":
+			opts.Args = append(opts.Args, args[i+1:]...)
+			return opts, nil
+		case strings.HasPrefix(arg, "--"):
+			err := opts.parseLong(arg)
+			if err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			err := opts.parseShort(arg)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			opts.Args = append(opts.Args, arg)
+		}
+	}
+
+	return opts, nil
+}
+
+// parseLong parses a '--' option
+func (self *Options) parseLong(arg string) error {
+	name := strings.SplitN(arg, "=", 2)[0]
+
+	switch name {
+	case "--sender":
+		return fail(exitUnsupported, "Pulling isn't supported, only pushing")
+	case "--delete", "--delete-before", "--delete-during", "--delete-delay", "--delete-after":
+		self.Delete = true
+	case "--delete-excluded":
+		self.Delete = true
+		self.DeleteExcluded = true
+	case "--numeric-ids":
+		self.NumericIds = true
+	case "--ignore-times":
+		self.IgnoreTimes = true
+	case "--size-only":
+		self.SizeOnly = true
+	case "--whole-file":
+		self.WholeFile = true
+	case "--devices":
+		self.Devices = true
+	case "--specials":
+		self.Specials = true
+	case "--timeout", "--partial", "--log-format", "--out-format":
+		// nothing for the receiver to do
+	default:
+		return fail(exitUnsupported, "Unsupported rsync option '%v'", name)
+	}
+
+	return nil
+}
+
+// parseShort parses a cluster of single letter options
+func (self *Options) parseShort(arg string) error {
+	for _, c := range arg[1:] {
+		switch c {
+		case 'e':
+			// the rest is the client's capabilities (eg. ".iLsfx")
+			return nil
+		case 'l':
+			self.Links = true
+		case 'o':
+			self.Owner = true
+		case 'g':
+			self.Group = true
+		case 'D':
+			self.Devices = true
+			self.Specials = true
+		case 't':
+			self.Times = true
+		case 'p':
+			self.Perms = true
+		case 'r':
+			self.Recursive = true
+		case 'O':
+			self.OmitDirTimes = true
+		case 'I':
+			self.IgnoreTimes = true
+		case 'W':
+			self.WholeFile = true
+		case 'v', 'q', 'i', 'R', 'd', 'x', 'k', 'L', 'J':
+			// verbosity, only meaningful to the sender, or link times
+			// which aren't set anyway
+		default:
+			return fail(exitUnsupported, "Unsupported rsync option '-%c'", c)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package ssh
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// single letter rsync server options a push may use. Left out are -s (the
+// real arguments would be sent in band, past the destination pinning), -K
+// (follows symlinked directories out of the stage) and -f (filters come in
+// band anyway).
+const shortOptions = "vqclogDtprROJIWxzSHXAEuUdbmnCkLiy"
+
+// long rsync server options a push may use, and whether they take a value.
+// Options naming local paths (eg. --temp-dir, --link-dest, --log-file) are
+// left out so a push can't touch anything outside its stage, as are those
+// writing files in place (--inplace, --append), which would change a file
+// still open elsewhere rather than replace it.
+var longOptions = map[string]*regexp.Regexp{
+	"--delete":          nil,
+	"--delete-before":   nil,
+	"--delete-during":   nil,
+	"--delete-delay":    nil,
+	"--delete-after":    nil,
+	"--delete-excluded": nil,
+	"--force":           nil,
+	"--ignore-errors":   nil,
+	"--numeric-ids":     nil,
+	"--ignore-times":    nil,
+	"--size-only":       nil,
+	"--whole-file":      nil,
+	"--no-whole-file":   nil,
+	"--devices":         nil,
+	"--specials":        nil,
+	"--partial":         nil,
+	"--existing":        nil,
+	"--ignore-existing": nil,
+	"--checksum-seed":   regexp.MustCompile(`^[0-9]+$`),
+	"--compress-level":  regexp.MustCompile(`^[0-9]$`),
+	"--timeout":         regexp.MustCompile(`^[0-9]+$`),
+	"--contimeout":      regexp.MustCompile(`^[0-9]+$`),
+	"--bwlimit":         regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kKmMgG]?$`),
+	"--max-delete":      regexp.MustCompile(`^-?[0-9]+$`),
+	"--max-size":        regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kKmMgGtTpP]?[bB]?([+-]1)?$`),
+	"--min-size":        regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kKmMgGtTpP]?[bB]?([+-]1)?$`),
+	"--modify-window":   regexp.MustCompile(`^-?[0-9]+$`),
+	"--block-size":      regexp.MustCompile(`^[0-9]+$`),
+	"--log-format":      regexp.MustCompile(`^[%a-zA-Z]*$`),
+	"--out-format":      regexp.MustCompile(`^[%a-zA-Z]*$`),
+}
+
+// the client's capabilities, following -e
+var capabilities = regexp.MustCompile(`^[.a-zA-Z]*$`)
+
+// serverArgs checks the rsync command a client asked to run and returns the
+// arguments to run rsync with. The client's options are kept but its
+// destination is replaced with the build's stage. Pushes to the embedded
+// receiver are checked against the same allow-list.
+func serverArgs(command, build string) ([]string, error) {
+	fields := strings.Fields(command)
+	if len(fields) < 2 || fields[0] != "rsync" || fields[1] != "--server" {
+		return nil, fmt.Errorf("Only 'rsync --server' may be run, not '%v'", command)
+	}
+
+	args := []string{"--server"}
+	var paths []string
+	for i := 2; i < len(fields); i++ {
+		arg := fields[i]
+
+		switch {
+		case arg == "--":
+			paths = append(paths, fields[i+1:]...)
+			i = len(fields)
+		case strings.HasPrefix(arg, "--"):
+			parts := strings.SplitN(arg, "=", 2)
+			value, ok := longOptions[parts[0]]
+			if !ok {
+				return nil, fmt.Errorf("Rsync option '%v' is not allowed", parts[0])
+			}
+			if (value == nil) != (len(parts) == 1) || (value != nil && !value.MatchString(parts[1])) {
+				return nil, fmt.Errorf("Rsync option '%v' has an invalid value", arg)
+			}
+			args = append(args, arg)
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			for j, c := range arg[1:] {
+				if c == 'e' {
+					if !capabilities.MatchString(arg[j+2:]) {
+						return nil, fmt.Errorf("Rsync capabilities '%v' are invalid", arg[j+2:])
+					}
+					break
+				}
+				if !strings.ContainsRune(shortOptions, c) {
+					return nil, fmt.Errorf("Rsync option '-%c' is not allowed", c)
+				}
+			}
+			args = append(args, arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+
+	// a push is "." followed by the destination
+	if len(paths) != 2 || paths[0] != "." {
+		return nil, fmt.Errorf("Rsync paths '%v' are not a push", strings.Join(paths, " "))
+	}
+
+	return append(args, ".", build+"/"), nil
+}
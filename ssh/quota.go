@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/dirsize"
+)
+
+// how often a stage the system rsync writes to is measured against
+// config.StageQuota
+var quotaInterval = time.Second
+
+// exit code of a session killed for its quota, rsync's RERR_FILEIO as for a
+// full disk
+const exitQuota = 11
+
+// returned by a write that would take a stage past config.StageQuota
+var errQuota = errors.New("Stage Quota Exceeded")
+
+// quota counts what a session writes into its stage against
+// config.StageQuota, killing the session once the stage would grow past it.
+// A file replaced with a smaller one, or removed over sftp, is counted back.
+type quota struct {
+	s        *session
+	stderr   io.Writer
+	limit    int64
+	size     int64 // bytes in the stage, measured at the start and counted since
+	exceeded int32
+}
+
+// newQuota measures a session's stage to count its writes from, nil if there
+// is no quota. A nil quota allows every write.
+func newQuota(s *session, stderr io.Writer) *quota {
+	if config.StageQuota <= 0 {
+		return nil
+	}
+
+	return &quota{
+		s:      s,
+		stderr: stderr,
+		limit:  config.StageQuota,
+		size:   dirsize.Of(filepath.Join(config.BuildDir, s.build)),
+	}
+}
+
+// grow counts n bytes more in the stage (fewer if n is negative), refusing
+// them if that takes the stage past its quota
+func (self *quota) grow(n int64) error {
+	if self == nil {
+		return nil
+	}
+
+	size := atomic.AddInt64(&self.size, n)
+	if n <= 0 || size <= self.limit {
+		return nil
+	}
+	atomic.AddInt64(&self.size, -n)
+
+	self.exceed(size)
+	return errQuota
+}
+
+// exceed kills the session for going past its quota, telling the client why
+// on stderr. Only the first call does.
+func (self *quota) exceed(size int64) {
+	if !atomic.CompareAndSwapInt32(&self.exceeded, 0, 1) {
+		return
+	}
+
+	config.Log.Info("Killing session of '%v', %d bytes in its stage is over the quota of %d", self.s.build, size, self.limit)
+	fmt.Fprintf(self.stderr, "slurp: stage '%v' exceeds its quota of %d bytes\n", self.s.build, self.limit)
+	self.s.kill()
+}
+
+// over reports whether the session was killed for its quota
+func (self *quota) over() bool {
+	return self != nil && atomic.LoadInt32(&self.exceeded) == 1
+}
+
+// watchQuota measures the stage of a system rsync session every
+// quotaInterval, killing the session once it's over config.StageQuota. The
+// system rsync writes where slurp can't count it, so the stage can overshoot
+// the quota by what is written between two measurements. The returned func
+// stops watching, and reports whether the session was killed for it.
+func watchQuota(s *session, stderr io.Writer) func() bool {
+	if config.StageQuota <= 0 {
+		return func() bool { return false }
+	}
+
+	q := &quota{s: s, stderr: stderr, limit: config.StageQuota}
+	done := make(chan struct{})
+	go func() {
+		dir := filepath.Join(config.BuildDir, s.build)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(quotaInterval):
+			}
+
+			size := dirsize.Of(dir)
+			if size > q.limit {
+				q.exceed(size)
+				return
+			}
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return q.over()
+	}
+}
+
+// beyond is how many of n bytes lie past the first old ones
+func beyond(n, old int64) int64 {
+	if n > old {
+		return n - old
+	}
+	return 0
+}
@@ -0,0 +1,372 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/nanobox-io/slurp/config"
+)
+
+// chroot serves sftp requests from within a stage's directory. Every path is
+// taken relative to the stage, and no path may go through a symlink, so an
+// upload can't reach outside of it.
+type chroot struct {
+	root  string
+	quota *quota // counts uploads against the stage's quota
+}
+
+// sftpRun serves the sftp subsystem for a build's stage, returning 1 if it
+// failed
+func sftpRun(channel ssh.Channel, build string) int {
+	defer channel.Close()
+
+	fs := &chroot{root: filepath.Join(config.BuildDir, build)}
+	server := sftp.NewRequestServer(channel, sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	})
+
+	endSync, err := beginSync(build)
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "slurp: %v\n", err)
+		exitStatus(channel, 1)
+		return 1
+	}
+	defer endSync()
+
+	s, err := startSession(build, func() error { return nil }, func() { server.Close() })
+	if err == ErrStopped {
+		fmt.Fprintf(channel.Stderr(), "%v, try again later\n", err)
+		exitStatus(channel, 1)
+		return 1
+	}
+	defer endSession(s)
+
+	config.Log.Trace("Serving sftp for '%v'", build)
+	fs.quota = newQuota(s, channel.Stderr())
+	err = server.Serve()
+	if fs.quota.over() {
+		return exitQuota
+	}
+	if err != nil && err != io.EOF {
+		config.Log.Error("Failed to serve sftp for '%v' - %v", build, err)
+		server.Close()
+		return 1
+	}
+	server.Close()
+
+	return 0
+}
+
+// Fileread opens a file for downloading
+func (self *chroot) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	p, err := self.path(req.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+}
+
+// Filewrite opens a file for uploading. The upload is written to a copy beside
+// the file and renamed over it once closed, so a file is replaced rather than
+// changed in place.
+func (self *chroot) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	p, err := self.path(req.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	pflags := req.Pflags()
+	info, err := os.Lstat(p)
+	switch {
+	case err == nil && pflags.Creat && pflags.Excl:
+		return nil, os.ErrExist
+	case err == nil && !info.Mode().IsRegular():
+		return nil, os.ErrPermission
+	case os.IsNotExist(err) && pflags.Creat:
+		// created once the upload is closed
+	case err != nil:
+		return nil, err
+	}
+	// O_APPEND can't be combined with WriteAt, appends come with offsets anyway
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return nil, err
+	}
+
+	// an existing file keeps its mode, and its content unless truncated
+	up := &upload{path: p, quota: self.quota}
+	mode := os.FileMode(0644)
+	if info != nil {
+		mode = info.Mode().Perm()
+		up.old = info.Size()
+	}
+	err = tmp.Chmod(mode)
+	if err == nil && info != nil && !pflags.Trunc {
+		err = copyFile(tmp, p)
+		up.size = up.old
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	up.File = tmp
+	return up, nil
+}
+
+// upload is a file being written over sftp, renamed over its path once
+// closed. What it outgrows the file it replaces by is counted against the
+// quota as it's written.
+type upload struct {
+	*os.File
+	path  string
+	quota *quota
+	old   int64 // bytes of the file replaced
+	size  int64 // bytes written so far, up to the furthest write
+	mutex sync.Mutex
+}
+
+func (self *upload) WriteAt(p []byte, off int64) (int, error) {
+	self.mutex.Lock()
+	if end := off + int64(len(p)); end > self.size {
+		err := self.quota.grow(beyond(end, self.old) - beyond(self.size, self.old))
+		if err != nil {
+			self.mutex.Unlock()
+			return 0, err
+		}
+		self.size = end
+	}
+	self.mutex.Unlock()
+
+	return self.File.WriteAt(p, off)
+}
+
+func (self *upload) Close() error {
+	err := self.File.Close()
+	if err == nil {
+		err = os.Rename(self.Name(), self.path)
+	}
+
+	// settle what was counted: the stage grew by the difference in size, or
+	// not at all if the upload was discarded
+	self.mutex.Lock()
+	counted := beyond(self.size, self.old)
+	self.mutex.Unlock()
+	if err == nil {
+		self.quota.grow(self.size - self.old - counted)
+	} else {
+		self.quota.grow(-counted)
+		os.Remove(self.Name())
+	}
+	return err
+}
+
+// copyFile copies the content of the file at path into w
+func copyFile(w io.Writer, path string) error {
+	file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// Filecmd changes the tree. Links are refused, a symlink's target would be
+// rewritten relative to the client's root rather than the stage.
+func (self *chroot) Filecmd(req *sftp.Request) error {
+	// renaming or removing a symlink doesn't follow it
+	p, err := self.path(req.Filepath, req.Method == "Rename" || req.Method == "Remove")
+	if err != nil {
+		return err
+	}
+
+	switch req.Method {
+	case "Setstat":
+		return self.setstat(p, req)
+	case "Rename":
+		target, err := self.path(req.Target, true)
+		if err != nil {
+			return err
+		}
+		// a file renamed over is no longer in the stage
+		src, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		replaced, _ := os.Lstat(target)
+		err = os.Rename(p, target)
+		if err == nil && replaced != nil && replaced.Mode().IsRegular() && !os.SameFile(src, replaced) {
+			self.quota.grow(-replaced.Size())
+		}
+		return err
+	case "Rmdir", "Remove":
+		if p == self.root {
+			return os.ErrPermission
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(p)
+		if err == nil && info.Mode().IsRegular() {
+			self.quota.grow(-info.Size())
+		}
+		return err
+	case "Mkdir":
+		return os.Mkdir(p, 0755)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// Filelist lists, stats and reads links
+func (self *chroot) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	p, err := self.path(req.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Method {
+	case "List":
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return listing(infos), nil
+	case "Stat":
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listing{info}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Lstat stats without following a symlink
+func (self *chroot) Lstat(req *sftp.Request) (sftp.ListerAt, error) {
+	p, err := self.path(req.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return listing{info}, nil
+}
+
+// Readlink returns a symlink's target as it was stored
+func (self *chroot) Readlink(name string) (string, error) {
+	p, err := self.path(name, true)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+// setstat applies the attributes a client sets. Owners are left alone.
+func (self *chroot) setstat(p string, req *sftp.Request) error {
+	flags := req.AttrFlags()
+	attrs := req.Attributes()
+
+	if flags.Size {
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		err = self.quota.grow(int64(attrs.Size) - info.Size())
+		if err != nil {
+			return err
+		}
+		err = os.Truncate(p, int64(attrs.Size))
+		if err != nil {
+			self.quota.grow(info.Size() - int64(attrs.Size))
+			return err
+		}
+	}
+	if flags.Permissions {
+		err := os.Chmod(p, attrs.FileMode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		err := os.Chtimes(p, attrs.AccessTime(), attrs.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// path resolves a client path within the stage, refusing any that goes
+// through a symlink. If link, the last element may be one, for requests that
+// don't follow it.
+func (self *chroot) path(name string, link bool) (string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return self.root, nil
+	}
+
+	parts := strings.Split(name[1:], "/")
+	if link {
+		parts = parts[:len(parts)-1]
+	}
+
+	p := self.root
+	for _, part := range parts {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if err != nil {
+			// missing elements fail on their own
+			break
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", os.ErrPermission
+		}
+	}
+
+	return filepath.Join(self.root, name), nil
+}
+
+// listing is a ListerAt over a set of file infos
+type listing []os.FileInfo
+
+func (self listing) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(self)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, self[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
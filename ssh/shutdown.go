@@ -0,0 +1,120 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nanobox-io/slurp/config"
+)
+
+var (
+	// returned when a session is started after Stop
+	ErrStopped = errors.New("Slurp Is Shutting Down")
+
+	// listener accepting ssh connections
+	listener net.Listener
+
+	// closed once Stop is called
+	stopping = make(chan struct{})
+	stopOnce = sync.Once{}
+
+	// running rsync servers
+	sessions     = map[*session]bool{}
+	sessionMutex = sync.Mutex{}
+	sessionWg    = sync.WaitGroup{}
+)
+
+// Stop closes the ssh listener and refuses new rsync sessions on connections
+// that are already open. Running sessions are left to Drain.
+func Stop() {
+	stopOnce.Do(func() {
+		close(stopping)
+
+		sessionMutex.Lock()
+		defer sessionMutex.Unlock()
+		if listener != nil {
+			listener.Close()
+		}
+	})
+}
+
+// Drain waits until deadline for running rsync sessions to finish, then kills
+// any that are left. It returns how many were killed.
+func Drain(deadline time.Time) int {
+	done := make(chan struct{})
+	go func() {
+		sessionWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-time.After(time.Until(deadline)):
+	}
+
+	sessionMutex.Lock()
+	killed := len(sessions)
+	for s := range sessions {
+		config.Log.Info("Killing rsync session of '%v'", s.build)
+		s.kill()
+	}
+	sessionMutex.Unlock()
+
+	// let the killed sessions report their end
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		config.Log.Error("Rsync sessions didn't exit after being killed")
+	}
+
+	return killed
+}
+
+// stopped reports whether Stop has been called.
+func stopped() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// session is a running rsync server, embedded or not
+type session struct {
+	build string
+	kill  func()
+}
+
+// startSession starts an rsync server and tracks it for Drain. It refuses to
+// once Stop is called, so Drain never misses a session.
+func startSession(build string, start func() error, kill func()) (*session, error) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	if stopped() {
+		return nil, ErrStopped
+	}
+
+	err := start()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{build: build, kill: kill}
+	sessions[s] = true
+	sessionWg.Add(1)
+	return s, nil
+}
+
+// endSession forgets a finished rsync server.
+func endSession(s *session) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	delete(sessions, s)
+	sessionWg.Done()
+}
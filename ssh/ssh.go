@@ -1,5 +1,6 @@
 // Package "ssh" contains the ssh server logic. It authenticates a user based
-// on the build-id and starts an rsync server for syncing code from the client.
+// on the build-id and its per-stage credential and starts an rsync server, or
+// serves sftp, for syncing code from the client.
 package ssh
 
 import (
@@ -7,6 +8,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -14,11 +16,17 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
+	"github.com/nanobox-io/slurp/buildid"
 	"github.com/nanobox-io/slurp/config"
+	"github.com/nanobox-io/slurp/logs"
+	"github.com/nanobox-io/slurp/metrics"
+	"github.com/nanobox-io/slurp/rsync"
 )
 
 // Check for host key, generate and write to a file if none exist
@@ -105,7 +113,8 @@ func Start() error {
 
 	// initialize ssh config
 	sshConfig := &ssh.ServerConfig{
-		PublicKeyCallback: userAuth,
+		PasswordCallback:  passwordAuth,
+		PublicKeyCallback: keyAuth,
 		ServerVersion:     "SSH-2.0-NANOPACK-SLURP",
 		AuthLogCallback:   logAuth,
 	}
@@ -119,6 +128,10 @@ func Start() error {
 		return fmt.Errorf("Failed to listen for rsync - %v", err)
 	}
 
+	sessionMutex.Lock()
+	listener = serverSocket
+	sessionMutex.Unlock()
+
 	config.Log.Info("SSH listening at %v...", config.SshAddr)
 
 	// accept connections
@@ -126,7 +139,12 @@ func Start() error {
 		for {
 			conn, err := serverSocket.Accept()
 			if err != nil {
+				if stopped() {
+					return
+				}
 				config.Log.Error("Failed to accept connection - %v", err)
+				// don't spin on a persistent error (eg. out of fds)
+				time.Sleep(100 * time.Millisecond)
 				continue
 			}
 			config.Log.Trace("Got connection")
@@ -138,26 +156,77 @@ func Start() error {
 
 // logAuth logs when a user is attempting to authenticate
 func logAuth(conn ssh.ConnMetadata, method string, err error) {
-	config.Log.Debug("User '%v' connecting from '%v' with '%v' method '%v'", conn.User(), conn.RemoteAddr().String(), string(conn.ClientVersion()), method)
+	entry := logs.Entry{
+		Kind:      "ssh-auth",
+		RequestId: requestId(conn),
+		BuildId:   conn.User(),
+		Remote:    conn.RemoteAddr().String(),
+		Op:        method + " " + string(conn.ClientVersion()),
+		Outcome:   "ok",
+	}
+	if err != nil {
+		entry.Outcome, entry.Error = "denied", err.Error()
+	}
+	logs.Access(entry)
+}
+
+// requestId is what a connection's logins and sessions are logged under
+func requestId(conn ssh.ConnMetadata) string {
+	return hex.EncodeToString(conn.SessionID())[:16]
+}
+
+// logSession logs an rsync or sftp session once it's done, and audits it as a
+// push by the stage's user, whether or not it succeeded
+func logSession(conn ssh.ConnMetadata, kind, op string, start time.Time, code int) {
+	outcome := "ok"
+	if code != 0 {
+		outcome = "error"
+	}
+
+	logs.Access(logs.Entry{
+		Kind:      kind,
+		RequestId: requestId(conn),
+		BuildId:   conn.User(),
+		Remote:    conn.RemoteAddr().String(),
+		Op:        op,
+		Duration:  time.Since(start).Seconds(),
+		Outcome:   outcome,
+		Status:    code,
+	})
+
+	logs.Audit(logs.Record{
+		Action:    logs.ActionPush,
+		BuildId:   conn.User(),
+		Actor:     conn.RemoteAddr().String(),
+		User:      conn.User(),
+		RequestId: requestId(conn),
+	})
 }
 
-// authenticate connection based on username
-func userAuth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+// authenticate connection based on username and the stage password
+func passwordAuth(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 	config.Log.Trace("Attempting to auth user: '%v'", conn.User())
-	// assign a new var here to prevent issues using a user as its deleted
-	for _, permittedUser := range authUsers {
-		if conn.User() == permittedUser {
-			config.Log.Debug("User: '%v' authorized", conn.User())
-			return nil, nil
-		}
+	if checkSecret(conn.User(), string(password)) {
+		config.Log.Debug("User: '%v' authorized", conn.User())
+		return nil, nil
+	}
+	config.Log.Error("User: '%v' not authorized!", conn.User())
+	return nil, fmt.Errorf("User not authorized!")
+}
+
+// authenticate connection based on username and the stage public key
+func keyAuth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	config.Log.Trace("Attempting to auth user: '%v'", conn.User())
+	if checkKey(conn.User(), key) {
+		config.Log.Debug("User: '%v' authorized", conn.User())
+		return nil, nil
 	}
-	config.Log.Error("User: '%v' not found!", conn.User())
-	return nil, fmt.Errorf("User not found!")
+	config.Log.Debug("User: '%v' key not authorized", conn.User())
+	return nil, fmt.Errorf("User not authorized!")
 }
 
 // handle tcp connection
 func handleConnection(conn net.Conn, sshConfig *ssh.ServerConfig) {
-	config.Log.Trace("Authorized users - %v", authUsers)
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
 	if err != nil {
 		config.Log.Error("Failed to handshake - %v", err)
@@ -167,6 +236,16 @@ func handleConnection(conn net.Conn, sshConfig *ssh.ServerConfig) {
 
 	defer sshConn.Close()
 
+	// the user names the stage, never serve one that could reach outside it
+	err = buildid.Validate(sshConn.User())
+	if err != nil {
+		config.Log.Error("Refusing connection - %v", err)
+		return
+	}
+
+	metrics.SshSessions.Inc()
+	defer metrics.SshSessions.Dec()
+
 	// service incoming request channel
 	go ssh.DiscardRequests(reqs)
 
@@ -176,12 +255,13 @@ func handleConnection(conn net.Conn, sshConfig *ssh.ServerConfig) {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
-		handleChannel(newChannel, sshConn.Conn.User())
+		handleChannel(newChannel, sshConn)
 	}
 }
 
 // handle ssh connections
-func handleChannel(newChannel ssh.NewChannel, build string) {
+func handleChannel(newChannel ssh.NewChannel, conn ssh.ConnMetadata) {
+	build := conn.User()
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		config.Log.Error("Failed to accept channel request - %v", err)
@@ -201,7 +281,38 @@ func handleChannel(newChannel ssh.NewChannel, build string) {
 					continue // todo: or break?
 				}
 
-				waitedRun(channel, build)
+				var payload struct{ Command string }
+				err := ssh.Unmarshal(req.Payload, &payload)
+				if err != nil {
+					config.Log.Debug("Bad exec payload - %v", err)
+					req.Reply(false, nil)
+					continue
+				}
+
+				// reply before running, the channel is closed once it's done
+				req.Reply(true, nil)
+				start := time.Now()
+				var code int
+				if config.EmbeddedRsync {
+					code = embeddedRun(channel, build, payload.Command)
+				} else {
+					code = waitedRun(channel, build, payload.Command)
+				}
+				logSession(conn, "rsync", payload.Command, start, code)
+				continue
+			case "subsystem":
+				var payload struct{ Name string }
+				err := ssh.Unmarshal(req.Payload, &payload)
+				if err != nil || payload.Name != "sftp" {
+					config.Log.Debug("Unknown subsystem - %v", payload.Name)
+					req.Reply(false, nil)
+					continue
+				}
+
+				req.Reply(true, nil)
+				start := time.Now()
+				logSession(conn, "sftp", "sftp", start, sftpRun(channel, build))
+				continue
 			case "env":
 				ok = true
 			}
@@ -210,12 +321,29 @@ func handleChannel(newChannel ssh.NewChannel, build string) {
 	}(requests)
 }
 
-// run command (rsync server)
-func waitedRun(channel ssh.Channel, build string) {
+// run command (rsync server) with the client's options, returning the exit
+// status sent to the client
+func waitedRun(channel ssh.Channel, build, command string) int {
 	defer channel.Close()
 
-	config.Log.Trace("Build: '%v'", build)
-	cmd := exec.Command("rsync", "--server", "-vlogDtprRe.iLsfx", "--delete", ".", build+"/")
+	config.Log.Trace("Build: '%v' Command: '%v'", build, command)
+	args, err := serverArgs(command, build)
+	if err != nil {
+		config.Log.Debug("Refused rsync command '%v' - %v", command, err)
+		fmt.Fprintf(channel.Stderr(), "slurp: %v\n", err)
+		exitStatus(channel, 1)
+		return 1
+	}
+
+	endSync, err := beginSync(build)
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "slurp: %v\n", err)
+		exitStatus(channel, 1)
+		return 1
+	}
+	defer endSync()
+
+	cmd := exec.Command("rsync", args...)
 	cmd.Dir = config.BuildDir
 
 	// connect stdin/out to the ssh pipe
@@ -224,11 +352,18 @@ func waitedRun(channel ssh.Channel, build string) {
 	cmd.Stderr = channel.Stderr()
 
 	// start running the command
-	err := cmd.Start()
+	s, err := startSession(build, cmd.Start, func() { cmd.Process.Kill() })
+	if err == ErrStopped {
+		fmt.Fprintf(channel.Stderr(), "%v, try again later\n", err)
+		exitStatus(channel, 1)
+		return 1
+	}
 	if err != nil || cmd.Process == nil {
 		config.Log.Fatal("Failed to run command - %v", err)
-		return
+		return 1
 	}
+	defer endSession(s)
+	overQuota := watchQuota(s, channel.Stderr())
 
 	config.Log.Trace("PID: %v\n", cmd.Process.Pid)
 
@@ -244,20 +379,97 @@ func waitedRun(channel ssh.Channel, build string) {
 	// release resources associated to process
 	cmd.Process.Release()
 
+	code := "signal"
+	if state.Exited() {
+		code = strconv.Itoa(state.ExitCode())
+	}
+	metrics.RsyncExits.WithLabelValues(code).Inc()
+
 	// check exit status
-	exitStatusBuffer := []byte{0, 0, 0, 0}
+	status := 0
 	if strings.Contains(state.String(), "exit status") {
-		status := strings.Split(state.String(), " ")[2]
-		if status != "0" {
-			// exit 1
-			exitStatusBuffer = []byte{0, 0, 0, 1}
+		if strings.Split(state.String(), " ")[2] != "0" {
+			status = 1
 		}
 	} else {
-		// exit 2
-		exitStatusBuffer = []byte{0, 0, 0, 2}
+		status = 2
+	}
+	if overQuota() {
+		status = exitQuota
 	}
 
 	// return exit status to client
-	channel.SendRequest("exit-status", true, exitStatusBuffer)
+	exitStatus(channel, status)
+	config.Log.Trace("Command's exit-status returned")
+
+	return status
+}
+
+// embeddedRun receives a push with the embedded rsync receiver, returning the
+// exit status sent to the client
+func embeddedRun(channel ssh.Channel, build, command string) int {
+	defer channel.Close()
+
+	config.Log.Trace("Build: '%v' Command: '%v'", build, command)
+
+	// the same allow-list as the system rsync, then what the receiver supports
+	_, err := serverArgs(command, build)
+	if err != nil {
+		config.Log.Debug("Refused rsync command '%v' - %v", command, err)
+		fmt.Fprintf(channel.Stderr(), "slurp: %v\n", err)
+		exitStatus(channel, 1)
+		return 1
+	}
+
+	opts, err := rsync.ParseCommand(command)
+	if err != nil {
+		config.Log.Debug("Refused rsync command '%v' - %v", command, err)
+		fmt.Fprintf(channel.Stderr(), "slurp: %v\n", err)
+		exitStatus(channel, rsync.ExitCode(err))
+		return rsync.ExitCode(err)
+	}
+
+	endSync, err := beginSync(build)
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "slurp: %v\n", err)
+		exitStatus(channel, 1)
+		return 1
+	}
+	defer endSync()
+
+	// closing the channel is what kills an embedded session
+	s, err := startSession(build, func() error { return nil }, func() { channel.Close() })
+	if err == ErrStopped {
+		fmt.Fprintf(channel.Stderr(), "%v, try again later\n", err)
+		exitStatus(channel, 1)
+		return 1
+	}
+	defer endSession(s)
+
+	// the files received are counted against the quota as they're written
+	q := newQuota(s, channel.Stderr())
+	if q != nil {
+		opts.Grow = q.grow
+	}
+
+	// the destination the client asked for is ignored, pushes land in the stage
+	err = rsync.Receive(channel, channel, filepath.Join(config.BuildDir, build), *opts)
+	if err != nil && !q.over() {
+		config.Log.Error("Failed to receive '%v' - %v", build, err)
+	}
+
+	code := rsync.ExitCode(err)
+	if q.over() {
+		code = exitQuota
+	}
+	metrics.RsyncExits.WithLabelValues(strconv.Itoa(code)).Inc()
+	exitStatus(channel, code)
 	config.Log.Trace("Command's exit-status returned")
+
+	return code
+}
+
+// exitStatus returns a command's exit status to the client
+func exitStatus(channel ssh.Channel, code int) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
 }
@@ -2,12 +2,17 @@ package ssh_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jcelliott/lumber"
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/nanobox-io/slurp/config"
 	"github.com/nanobox-io/slurp/ssh"
@@ -32,17 +37,57 @@ func TestMain(m *testing.M) {
 	os.RemoveAll("/tmp/slurpSsh")
 	os.RemoveAll("/tmp/slurp_rsa")
 	os.RemoveAll("/tmp/sshTest")
+	os.RemoveAll("/tmp/slurp-usr")
 
 	os.Exit(rtn)
 }
 
+// login for the sshTest user
+var login ssh.Login
+
 func TestAddUser(t *testing.T) {
-	err := ssh.AddUser("sshTest")
+	var cred ssh.Credential
+	var err error
+	login, cred, err = ssh.NewCredential("sshTest", true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	err = ssh.AddUser("sshTest", cred)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
+func TestAuth(t *testing.T) {
+	auths := map[string]gossh.AuthMethod{
+		"password": gossh.Password(login.Secret),
+		"key":      gossh.PublicKeys(signer(t, login.PrivateKey)),
+	}
+	for method, auth := range auths {
+		client, err := dial("sshTest", auth)
+		if err != nil {
+			t.Errorf("%v auth failed - %v", method, err)
+			continue
+		}
+		client.Close()
+	}
+
+	// wrong secret
+	_, err := dial("sshTest", gossh.Password("sshTest"))
+	if err == nil {
+		t.Errorf("auth with wrong secret succeeded")
+	}
+
+	// unknown key
+	other, _, _ := ssh.NewCredential("other", true)
+	_, err = dial("sshTest", gossh.PublicKeys(signer(t, other.PrivateKey)))
+	if err == nil {
+		t.Errorf("auth with unknown key succeeded")
+	}
+}
+
 func TestCommitStage(t *testing.T) {
 	err := os.MkdirAll("/tmp/sshTest", 0755)
 	if err != nil {
@@ -62,7 +107,11 @@ func TestCommitStage(t *testing.T) {
 		t.FailNow()
 	}
 
-	exec.Command("bash", "-c", "ssh-keygen -t rsa -b 2048 -C 'slurp@test' -N '' -f /tmp/slurp-usr").Run()
+	err = ioutil.WriteFile("/tmp/slurp-usr", []byte(login.PrivateKey), 0600)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
 	cmd := exec.Command("rsync", "-v", "--delete", "-aR", ".", "-e", "ssh -i /tmp/slurp-usr -p 1567 -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null", "sshTest@127.0.0.1:sshTest")
 	cmd.Dir = "/tmp/sshTest/"
 	out, err := cmd.CombinedOutput()
@@ -73,6 +122,202 @@ func TestCommitStage(t *testing.T) {
 	}
 }
 
+func TestRefuseOptions(t *testing.T) {
+	config.EmbeddedRsync = true
+	defer func() { config.EmbeddedRsync = false }()
+
+	// compression isn't supported by the embedded receiver
+	out, err := run(t, "rsync --server -vlogDtprze.iLsfx --delete . sshTest/")
+	exit, ok := err.(*gossh.ExitError)
+	if !ok || exit.ExitStatus() != 4 {
+		t.Errorf("%v doesn't match expected exit status 4 - %s", err, out)
+	}
+}
+
+func TestRefuseCommand(t *testing.T) {
+	defer func() { config.EmbeddedRsync = false }()
+
+	commands := []string{
+		"rm -rf /",
+		"rsync --server --log-file=/etc/passwd -vlogDtprRe.iLsfx . sshTest/",
+		"rsync --server -vlogDtprsRe.iLsfx . sshTest/",
+		"rsync --server -vlogDtprRe.iLsfx --timeout=soon . sshTest/",
+		"rsync --server --sender -vlogDtprRe.iLsfx . sshTest/",
+		"rsync --server -vlogDtprRe.iLsfx --inplace . sshTest/",
+		"rsync --server -vlogDtprRe.iLsfx --append . sshTest/",
+	}
+
+	// the same allow-list applies to both receivers
+	for _, embedded := range []bool{false, true} {
+		config.EmbeddedRsync = embedded
+		for _, command := range commands {
+			out, err := run(t, command)
+			exit, ok := err.(*gossh.ExitError)
+			if !ok || exit.ExitStatus() != 1 || !strings.HasPrefix(string(out), "slurp: ") {
+				t.Errorf("'%v' wasn't refused (embedded: %v) - %v %s", command, embedded, err, out)
+			}
+		}
+	}
+}
+
+func TestSftp(t *testing.T) {
+	// core creates the stage
+	os.MkdirAll("/tmp/slurpSsh/sshTest", 0755)
+
+	client, err := dial("sshTest", gossh.Password(login.Secret))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer sftpClient.Close()
+
+	// paths are within the stage, however they're written
+	err = sftpClient.MkdirAll("/app/../../../app")
+	if err != nil {
+		t.Error(err)
+	}
+	file, err := sftpClient.Create("/app/upload")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	file.Write([]byte("uploaded"))
+	file.Close()
+
+	content, err := ioutil.ReadFile("/tmp/slurpSsh/sshTest/app/upload")
+	if err != nil || string(content) != "uploaded" {
+		t.Errorf("upload doesn't match expected - %q %v", content, err)
+	}
+
+	// a file is replaced, not written in place, and keeps what isn't rewritten
+	os.Link("/tmp/slurpSsh/sshTest/app/upload", "/tmp/slurpSsh/linked")
+	defer os.Remove("/tmp/slurpSsh/linked")
+	file, err = sftpClient.OpenFile("/app/upload", os.O_WRONLY)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	file.Write([]byte("UP"))
+	file.Close()
+
+	content, _ = ioutil.ReadFile("/tmp/slurpSsh/sshTest/app/upload")
+	if string(content) != "UPloaded" {
+		t.Errorf("%q doesn't match expected content", content)
+	}
+	content, _ = ioutil.ReadFile("/tmp/slurpSsh/linked")
+	if string(content) != "uploaded" {
+		t.Errorf("the other link was written to - %q", content)
+	}
+
+	// symlinks can't be made, nor followed out of the stage
+	err = sftpClient.Symlink("/etc", "/etc")
+	if err == nil {
+		t.Errorf("symlink succeeded")
+	}
+	os.Symlink("/tmp", "/tmp/slurpSsh/sshTest/escape")
+	_, err = sftpClient.Create("/escape/file")
+	if err == nil {
+		t.Errorf("created a file through a symlink")
+	}
+	_, err = sftpClient.Open("/escape")
+	if err == nil {
+		t.Errorf("opened a symlink")
+	}
+}
+
+func TestSyncHook(t *testing.T) {
+	ssh.SyncHook = func(build string, active bool) error {
+		if active {
+			return fmt.Errorf("Build Is Busy")
+		}
+		return nil
+	}
+	defer func() { ssh.SyncHook = nil }()
+
+	client, err := dial("sshTest", gossh.Password(login.Secret))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer client.Close()
+
+	// the session is refused once the subsystem starts
+	sftpClient, err := sftp.NewClient(client)
+	if err == nil {
+		_, err = sftpClient.Create("/app/refused")
+		sftpClient.Close()
+	}
+	if err == nil {
+		t.Errorf("session started for a busy build")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	config.StageQuota = 1 << 20
+	defer func() { config.StageQuota = 0 }()
+
+	client, err := dial("sshTest", gossh.Password(login.Secret))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer sftpClient.Close()
+
+	// a file rewritten counts once, not once per upload
+	chunk := make([]byte, 64<<10)
+	for i := 0; i < 3; i++ {
+		file, err := sftpClient.Create("/app/rewritten")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		for j := 0; j < 8 && err == nil; j++ {
+			_, err = file.Write(chunk)
+		}
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			t.Errorf("rewrite %d refused - %v", i, err)
+		}
+	}
+
+	file, err := sftpClient.Create("/app/large")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer file.Close()
+
+	// the session is killed once what it writes takes the stage past the quota
+	deadline := time.Now().Add(10 * time.Second)
+	for err == nil && time.Now().Before(deadline) {
+		_, err = file.Write(chunk)
+	}
+	if err == nil {
+		t.Errorf("session outlived its quota")
+	}
+
+	// and it ends, rather than being left for Drain to kill
+	if killed := ssh.Drain(time.Now().Add(5 * time.Second)); killed != 0 {
+		t.Errorf("%d sessions still running", killed)
+	}
+}
+
 func TestDelUser(t *testing.T) {
 	err := ssh.DelUser("sshTest")
 	if err != nil {
@@ -80,6 +325,45 @@ func TestDelUser(t *testing.T) {
 	}
 }
 
+// must run last, a stopped server stays stopped
+func TestStop(t *testing.T) {
+	stopLogin, cred, err := ssh.NewCredential("sshStop", false)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = ssh.AddUser("sshStop", cred)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer ssh.DelUser("sshStop")
+
+	// a valid login, so only the stop can refuse it
+	client, err := dial("sshStop", gossh.Password(stopLogin.Secret))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	client.Close()
+
+	ssh.Stop()
+
+	_, err = dial("sshStop", gossh.Password(stopLogin.Secret))
+	if err == nil {
+		t.Error("connected after stop")
+	}
+	conn, err := net.Dial("tcp", config.SshAddr)
+	if err == nil {
+		conn.Close()
+		t.Error("listening after stop")
+	}
+
+	if killed := ssh.Drain(time.Now()); killed != 0 {
+		t.Errorf("%d sessions killed, none were running", killed)
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // PRIVS
 ////////////////////////////////////////////////////////////////////////////////
@@ -98,3 +382,39 @@ func initialize() {
 		os.Exit(1)
 	}
 }
+
+// connect to the ssh server as user
+func dial(user string, auth gossh.AuthMethod) (*gossh.Client, error) {
+	return gossh.Dial("tcp", config.SshAddr, &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{auth},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+}
+
+// parse a PEM encoded private key
+func signer(t *testing.T, key string) gossh.Signer {
+	signer, err := gossh.ParsePrivateKey([]byte(key))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return signer
+}
+
+// run runs command as the sshTest user, returning its output
+func run(t *testing.T, command string) ([]byte, error) {
+	client, err := dial("sshTest", gossh.Password(login.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	return session.CombinedOutput(command)
+}
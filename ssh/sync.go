@@ -1,24 +1,93 @@
 package ssh
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
 	"sync"
 
+	"golang.org/x/crypto/ssh"
+
+	"github.com/nanobox-io/slurp/buildid"
 	"github.com/nanobox-io/slurp/config"
 )
 
+// Credential is what slurp keeps to authenticate a user. The secrets
+// themselves are only handed to the client.
+type Credential struct {
+	SecretHash string `json:"secret-hash"`          // hex encoded sha256 of the password
+	PublicKey  string `json:"public-key,omitempty"` // authorized_keys formatted key
+}
+
+// Login is what a client needs to authenticate as a user.
+type Login struct {
+	User       string // username (build id)
+	Secret     string // password
+	PrivateKey string // PEM encoded private key, if a keypair was requested
+}
+
 var (
-	// copy of all non-committed users
-	authUsers []string
+	// credentials of all non-committed users
+	authUsers = map[string]Credential{}
 
 	// mutex ensures updates to authUsers are atomic
 	mutex = sync.Mutex{}
+
+	// SyncHook, if set, is called as an rsync session for a build starts
+	// (active) and ends. A session it returns an error for is refused.
+	SyncHook func(build string, active bool) error
 )
 
-// Add an authorized user
-func AddUser(user string) error {
+// beginSync tells SyncHook a session for build starts, returning the func
+// telling it the session ended.
+func beginSync(build string) (func(), error) {
+	if SyncHook == nil {
+		return func() {}, nil
+	}
+
+	err := SyncHook(build, true)
+	if err != nil {
+		return nil, err
+	}
+	return func() { SyncHook(build, false) }, nil
+}
+
+// NewCredential generates a random password for user and, if withKey, a
+// keypair. The Login is for the client, the Credential for AddUser.
+func NewCredential(user string, withKey bool) (Login, Credential, error) {
+	login := Login{User: user}
+
+	secret := make([]byte, 24)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return Login{}, Credential{}, fmt.Errorf("Failed to generate secret - %v", err)
+	}
+	login.Secret = hex.EncodeToString(secret)
+
+	cred := Credential{SecretHash: hashSecret(login.Secret)}
+
+	if withKey {
+		cred.PublicKey, login.PrivateKey, err = genKeyPair()
+		if err != nil {
+			return Login{}, Credential{}, fmt.Errorf("Failed to generate keypair - %v", err)
+		}
+	}
+
+	return login, cred, nil
+}
+
+// Add an authorized user. The user is a build id, so it must be valid.
+func AddUser(user string, cred Credential) error {
+	err := buildid.Validate(user)
+	if err != nil {
+		return err
+	}
+
 	config.Log.Trace("Adding user %v", user)
 	mutex.Lock()
-	authUsers = append(authUsers, user)
+	authUsers[user] = cred
 	mutex.Unlock()
 
 	return nil
@@ -28,13 +97,43 @@ func AddUser(user string) error {
 func DelUser(user string) error {
 	config.Log.Trace("Removing user %v", user)
 	mutex.Lock()
-	for i := range authUsers {
-		if authUsers[i] == user {
-			authUsers = append(authUsers[:i], authUsers[i+1:]...)
-			break
-		}
-	}
+	delete(authUsers, user)
 	mutex.Unlock()
 
 	return nil
 }
+
+// checkSecret reports whether secret is user's password
+func checkSecret(user, secret string) bool {
+	mutex.Lock()
+	cred, ok := authUsers[user]
+	mutex.Unlock()
+
+	hash := hashSecret(secret)
+	return ok && subtle.ConstantTimeCompare([]byte(hash), []byte(cred.SecretHash)) == 1
+}
+
+// checkKey reports whether key is user's public key
+func checkKey(user string, key ssh.PublicKey) bool {
+	mutex.Lock()
+	cred, ok := authUsers[user]
+	mutex.Unlock()
+
+	if !ok || cred.PublicKey == "" {
+		return false
+	}
+
+	authorized, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cred.PublicKey))
+	if err != nil {
+		config.Log.Error("Failed to parse key of user '%v' - %v", user, err)
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(authorized.Marshal(), key.Marshal()) == 1
+}
+
+// hashSecret hashes a password for storage and comparison
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}